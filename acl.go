@@ -0,0 +1,180 @@
+package vforward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+type aclRule struct {
+	allow bool
+	ipnet *net.IPNet
+}
+
+// ACL 访问控制列表，按添加顺序匹配规则，第一条匹配的规则决定允许或拒绝，没有规则匹配则允许。
+// 拒绝其它地址可以在最后添加 Deny("all")。
+type ACL struct {
+	rules []aclRule
+	mu    sync.RWMutex
+}
+
+// ParseACL 读取访问控制列表，每行一条规则，# 开头为注释。
+//
+//	allow 10.0.0.0/8
+//	allow 2001:db8::/32
+//	deny  192.168.1.1
+//	deny  all
+//
+//	r io.Reader     规则
+//	*ACL            访问控制列表
+//	error           错误
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := new(ACL)
+	scan := bufio.NewScanner(r)
+	for line := 1; scan.Scan(); line++ {
+		text := strings.TrimSpace(scan.Text())
+		if i := strings.Index(text, "#"); i != -1 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("vforward: 访问控制第%d行格式错误 %q", line, text)
+		}
+		var err error
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			err = acl.Allow(fields[1])
+		case "deny":
+			err = acl.Deny(fields[1])
+		default:
+			err = fmt.Errorf("vforward: 访问控制规则 %q 是未知的", fields[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("vforward: 访问控制第%d行 %v", line, err)
+		}
+	}
+	return acl, scan.Err()
+}
+
+// LoadACL 从文件读取访问控制列表，格式见 ParseACL
+//
+//	file string     文件路径
+//	*ACL            访问控制列表
+//	error           错误
+func LoadACL(file string) (*ACL, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// Allow 添加允许规则
+//
+//	cidr string     IP或网段，支持IPv4和IPv6，all 表示全部
+//	error           错误
+func (T *ACL) Allow(cidr string) error {
+	return T.add(true, cidr)
+}
+
+// Deny 添加拒绝规则
+//
+//	cidr string     IP或网段，支持IPv4和IPv6，all 表示全部
+//	error           错误
+func (T *ACL) Deny(cidr string) error {
+	return T.add(false, cidr)
+}
+
+func (T *ACL) add(allow bool, cidr string) error {
+	var ipnets []*net.IPNet
+	if strings.EqualFold(cidr, "all") {
+		_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+		_, v6, _ := net.ParseCIDR("::/0")
+		ipnets = append(ipnets, v4, v6)
+	} else {
+		ipnet, err := parseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	for _, ipnet := range ipnets {
+		T.rules = append(T.rules, aclRule{allow: allow, ipnet: ipnet})
+	}
+	return nil
+}
+
+// Permit 判断地址是否允许访问，ACL为nil时全部允许
+//
+//	addr net.Addr   地址
+//	bool            允许
+func (T *ACL) Permit(addr net.Addr) bool {
+	if T == nil {
+		return true
+	}
+	allow, ok := T.match(addrIP(addr))
+	return allow || !ok
+}
+
+// match 按顺序匹配规则
+func (T *ACL) match(ip net.IP) (allow bool, ok bool) {
+	if ip == nil {
+		return false, false
+	}
+	T.mu.RLock()
+	defer T.mu.RUnlock()
+	for _, rule := range T.rules {
+		if rule.ipnet.Contains(ip) {
+			return rule.allow, true
+		}
+	}
+	return false, false
+}
+
+// 解析网段，没有掩码的IP视为单个地址
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("vforward: IP地址 %q 格式错误", cidr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	return ipnet, err
+}
+
+// 地址中的IP，IPv4映射的IPv6地址转为IPv4
+func addrIP(addr net.Addr) net.IP {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return nil
+		}
+		ip = net.ParseIP(addrHost(addr))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
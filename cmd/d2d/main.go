@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/456vv/vforward"
@@ -17,12 +21,26 @@ var (
 	fALocal  = flag.String("ALocal", "0.0.0.0", "A端本地发起连接地址")
 	fARemote = flag.String("ARemote", "", "A端远程请求连接地址 (format \"12.13.14.15:123\")")
 	fAVerify = flag.String("AVerify", "", "A的验证字符串，桥接后的发出的第一条验证数据头。")
+
+	fATLS           = flag.Bool("ATLS", false, "向A端发起TLS连接")
+	fATLSServerName = flag.String("ATLSServerName", "", "A端证书的主机名，不填使用远程地址")
+	fATLSCA         = flag.String("ATLSCA", "", "A端CA证书文件，不填使用系统CA")
+	fATLSCert       = flag.String("ATLSCert", "", "向A端出示的客户端证书文件")
+	fATLSKey        = flag.String("ATLSKey", "", "向A端出示的客户端私钥文件")
+	fATLSPin        = flag.String("ATLSPin", "", "A端证书公钥SHA256哈希(base64)，多个用逗号分隔，不填CA时只校验公钥")
 )
 
 var (
 	fBLocal  = flag.String("BLocal", "0.0.0.0", "B端本地发起连接地址")
 	fBRemote = flag.String("BRemote", "", "B端远程请求连接地址 (format \"22.23.24.25:234\")")
 	fBVerify = flag.String("BVerify", "", "B的验证字符串，桥接后的发出的第一条验证数据头。")
+
+	fBTLS           = flag.Bool("BTLS", false, "向B端发起TLS连接")
+	fBTLSServerName = flag.String("BTLSServerName", "", "B端证书的主机名，不填使用远程地址")
+	fBTLSCA         = flag.String("BTLSCA", "", "B端CA证书文件，不填使用系统CA")
+	fBTLSCert       = flag.String("BTLSCert", "", "向B端出示的客户端证书文件")
+	fBTLSKey        = flag.String("BTLSKey", "", "向B端出示的客户端私钥文件")
+	fBTLSPin        = flag.String("BTLSPin", "", "B端证书公钥SHA256哈希(base64)，多个用逗号分隔，不填CA时只校验公钥")
 )
 
 var (
@@ -32,8 +50,33 @@ var (
 	fKeptIdeConn = flag.Int("KeptIdeConn", 2, "保持一方连接数量，以备快速互相连接。")
 	fIdeTimeout  = flag.String("IdeTimeout", "0s", "空闲连接超时。单位：ns, us, ms, s, m, h")
 	fReadBufSize = flag.Int("ReadBufSize", 4096, "交换数据缓冲大小。单位：字节")
+	fHealthCheck = flag.String("HealthCheck", "0s", "远程健康检查间隔，0s 不检查。单位：ns, us, ms, s, m, h")
+
+	fAUDPOverTCP = flag.Bool("AUDPOverTCP", false, "A端使用UDP，数据报前面加上2字节长度与B端的TCP交换")
+	fBUDPOverTCP = flag.Bool("BUDPOverTCP", false, "B端使用UDP，数据报前面加上2字节长度与A端的TCP交换")
+
+	fRUDPWindow       = flag.Int("RUDPWindow", 128, "可靠UDP的发送和接收窗口。单位：段")
+	fRUDPNoCongestion = flag.Bool("RUDPNoCongestion", false, "可靠UDP关闭拥塞控制，只受窗口限制")
+
+	fProxyProto = flag.Int("ProxyProtocol", 0, "配对后向B端发送PROXY协议头，携带A端的地址，B端需要是TCP。1 文本格式，2 二进制格式，0 不发送")
+
+	fHalfCloseTimeout = flag.String("HalfCloseTimeout", "30s", "一方结束后半关闭另一方，等待另一方向结束的时间，超时关闭双方。-1s 不半关闭。单位：ns, us, ms, s, m, h")
+
+	fRateLimitConn    = flag.String("RateLimitConn", "0", "每个连接的带宽，上行为A发往B，格式 上行,下行，只有一个值时上行和下行相同。单位：字节/秒，可以加上 K, M, G。0 不限制")
+	fRateLimitIP      = flag.String("RateLimitIP", "0", "每个来源IP的带宽，格式同 -RateLimitConn")
+	fRateLimitSwap    = flag.String("RateLimitSwap", "0", "全部连接共用的带宽，格式同 -RateLimitConn")
+	fRateLimitProcess = flag.String("RateLimitProcess", "0", "进程内全部连接共用的带宽，格式同 -RateLimitConn")
+
+	fMetricsListen = flag.String("MetricsListen", "", "指标监听地址，在 /metrics 输出Prometheus文本格式的统计 (format \"127.0.0.1:9100\")")
+	fMetricsName   = flag.String("MetricsName", "", "规则名称，用于指标的 rule 标签和日志的 rule 字段，不填使用A端远程地址-B端远程地址")
+
+	fLogLevel  = flag.String("LogLevel", "info", "日志级别：debug, info, warn, error")
+	fLogFormat = flag.String("LogFormat", "text", "日志格式：text 文本, json 每行一个JSON对象")
 )
 
+// 读取验证数据超时
+const verifyTimeout = 10 * time.Second
+
 //commandline:d2d-main.exe -ARemote 127.0.0.1:1201 -BRemote 127.0.0.1:1202 -Network udp
 func main() {
 	flag.Parse()
@@ -53,39 +96,70 @@ func main() {
 		return
 	}
 
-	var (
-		addra = vforward.Addr{Network: *fNetwork, Local: &net.TCPAddr{IP: net.ParseIP(*fALocal), Port: 0}}
-		addrb = vforward.Addr{Network: *fNetwork, Local: &net.TCPAddr{IP: net.ParseIP(*fBLocal), Port: 0}}
-	)
-	switch *fNetwork {
-	case "tcp", "tcp4", "tcp6":
-		addra.Remote, err = net.ResolveTCPAddr(*fNetwork, *fARemote)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		addrb.Remote, err = net.ResolveTCPAddr(*fNetwork, *fBRemote)
-		if err != nil {
-			log.Println(err)
-			return
+	// 日志和规则名称
+	level, err := vforward.ParseLogLevel(*fLogLevel)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var logger vforward.Logger
+	switch *fLogFormat {
+	case "text":
+		logger = vforward.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), level)
+	case "json":
+		logger = vforward.NewJSONLogger(os.Stderr, level)
+	default:
+		log.Printf("日志格式 %q 是未知的，仅支持：text, json", *fLogFormat)
+		return
+	}
+	name := *fMetricsName
+	if name == "" {
+		name = *fARemote + "-" + *fBRemote
+	}
+
+	// 按帧交换的一方使用UDP
+	udpNetwork := func(network string, on bool) string {
+		if on && strings.HasPrefix(network, "tcp") {
+			return "udp" + network[3:]
 		}
-	case "udp", "udp4", "udp6":
-		addra.Remote, err = net.ResolveUDPAddr(*fNetwork, *fARemote)
-		if err != nil {
-			log.Println(err)
-			return
+		return network
+	}
+	resolve := func(network, address string) (net.Addr, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			return net.ResolveTCPAddr(network, address)
+		case "udp", "udp4", "udp6":
+			return net.ResolveUDPAddr(network, address)
+		case "rudp", "rudp4", "rudp6":
+			// 可靠UDP
+			return net.ResolveUDPAddr(strings.TrimPrefix(network, "r"), address)
 		}
-		addrb.Remote, err = net.ResolveUDPAddr(*fNetwork, *fBRemote)
-		if err != nil {
-			log.Println(err)
-			return
+		return nil, fmt.Errorf("网络地址类型  %q 是未知的，日前仅支持：tcp/tcp4/tcp6, upd/udp4/udp6 或 rudp/rudp4/rudp6", network)
+	}
+	local := func(network, ip string) net.Addr {
+		if strings.HasPrefix(network, "udp") {
+			return &net.UDPAddr{IP: net.ParseIP(ip), Port: 0}
 		}
-	default:
-		log.Printf("网络地址类型  %q 是未知的，日前仅支持：tcp/tcp4/tcp6 或 upd/udp4/udp6", *fNetwork)
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 0}
+	}
+	var (
+		addra = vforward.Addr{Network: udpNetwork(*fNetwork, *fAUDPOverTCP)}
+		addrb = vforward.Addr{Network: udpNetwork(*fNetwork, *fBUDPOverTCP)}
+	)
+	addra.Local = local(addra.Network, *fALocal)
+	addrb.Local = local(addrb.Network, *fBLocal)
+	if addra.Remote, err = resolve(addra.Network, *fARemote); err != nil {
+		log.Println(err)
+		return
+	}
+	if addrb.Remote, err = resolve(addrb.Network, *fBRemote); err != nil {
+		log.Println(err)
 		return
 	}
 
 	dd := new(vforward.D2D)
+	dd.Logger = logger
+	dd.Name = name
 
 	// 尝试或发起连接时间，可能一方不在线，会间隔尝试连接对方。
 	if dd.TryConnTime, err = time.ParseDuration(*fTryConnTime); err != nil {
@@ -108,7 +182,71 @@ func main() {
 	dd.IdeTimeout(d)
 	dd.MaxConn(*fMaxConn)
 	dd.KeptIdeConn(*fKeptIdeConn)
+	// 半关闭超时
+	if dd.HalfCloseTimeout, err = time.ParseDuration(*fHalfCloseTimeout); err != nil {
+		log.Println(err)
+		return
+	}
 	dd.ReadBufSize = *fReadBufSize // 交换数据缓冲大小
+	dd.RUDP = &vforward.RUDPConfig{SendWindow: *fRUDPWindow, RecvWindow: *fRUDPWindow, NoCongestion: *fRUDPNoCongestion}
+	// PROXY协议头
+	dd.ProxyProtocol = *fProxyProto
+
+	// 带宽限制
+	rate := new(vforward.RateLimit)
+	limited := false
+	for _, r := range []struct {
+		s   string
+		set func(up, down float64)
+	}{
+		{*fRateLimitConn, rate.SetConn},
+		{*fRateLimitIP, rate.SetIP},
+		{*fRateLimitSwap, rate.SetSwap},
+		{*fRateLimitProcess, vforward.SetProcessRate},
+	} {
+		up, down, err := vforward.ParseRate(r.s)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		r.set(up, down)
+		limited = limited || up > 0 || down > 0
+	}
+	if limited {
+		dd.RateLimit = rate
+	}
+
+	// 远程健康检查
+	if d, err := time.ParseDuration(*fHealthCheck); err != nil {
+		log.Println(err)
+		return
+	} else if d > 0 {
+		dd.HealthCheck = &vforward.HealthCheck{Interval: d}
+	}
+
+	// TLS
+	tlsConfig := func(on bool, serverName, ca, cert, key, pin string) (*tls.Config, error) {
+		if !on {
+			return nil, nil
+		}
+		var pins []string
+		if pin != "" {
+			pins = strings.Split(pin, ",")
+		}
+		return vforward.NewTLSClientConfig(serverName, ca, cert, key, pins...)
+	}
+	atls, err := tlsConfig(*fATLS, *fATLSServerName, *fATLSCA, *fATLSCert, *fATLSKey, *fATLSPin)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	btls, err := tlsConfig(*fBTLS, *fBTLSServerName, *fBTLSCA, *fBTLSCert, *fBTLSKey, *fBTLSPin)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	dd.TLSConfig(atls, btls)
+	dd.UDPOverTCP(*fAUDPOverTCP, *fBUDPOverTCP)
 
 	oa := func(v string) [][]byte {
 		vs := bytes.SplitN([]byte(v), []byte("|"), 2)
@@ -126,10 +264,12 @@ func main() {
 				return false
 			}
 
+			conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+			defer conn.SetReadDeadline(time.Time{})
 			p := make([]byte, len(vs[1]))
 			if n, err := conn.Read(p); err != nil || !bytes.Equal(p[:n], vs[1]) {
 				conn.Close()
-				fmt.Printf("verify error, %s != %s \n", v, p[:n])
+				logger.Log(vforward.LevelWarn, "验证数据错误", "rule", name, "remote", conn.RemoteAddr(), "size", n)
 				return false
 			}
 		}
@@ -148,6 +288,22 @@ func main() {
 		return
 	}
 	defer dds.Close()
+
+	// 指标
+	if *fMetricsListen != "" {
+		ml, err := net.Listen("tcp", *fMetricsListen)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer ml.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", vforward.MetricsHandler(func() map[string]vforward.Stats {
+			return map[string]vforward.Stats{name: dds.Stats()}
+		}))
+		go http.Serve(ml, mux)
+	}
+
 	if err = dds.Swap(); err != nil {
 		log.Printf("错误：%s\n", err)
 	}
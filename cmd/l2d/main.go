@@ -6,6 +6,11 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/456vv/vforward"
@@ -16,20 +21,70 @@ var fNetwork = flag.String("Network", "tcp", "网络地址类型")
 var (
 	fListen  = flag.String("Listen", "", "本地网卡监听地址 (format \"0.0.0.0:123\")")
 	fAVerify = flag.String("AVerify", "", "监听端的验证字符串，收到客户端发来的验证数据头。")
+	fACL     = flag.String("ACL", "", "监听端的访问控制文件，每行一条规则 (format \"allow 10.0.0.0/8\", \"deny all\")")
+
+	fProxyAccept  = flag.String("ProxyAccept", "", "监听端接收PROXY协议头：on 接收, strict 严格模式，拒绝非信任来源和没有发送协议头的连接")
+	fTLSCert      = flag.String("TLSCert", "", "监听端TLS证书文件，文件修改后自动重新加载")
+	fTLSKey       = flag.String("TLSKey", "", "监听端TLS私钥文件")
+	fTLSClientCA  = flag.String("TLSClientCA", "", "监听端客户端CA证书文件，填写后客户端必须出示由该CA签发的证书")
+	fIdentity     = flag.String("Identity", "", "监听端客户端证书身份映射文件，每行一条 (format \"client1.example.com client1\")，没有对应身份的证书被拒绝")
+	fProxyTrusted = flag.String("ProxyTrusted", "", "PROXY协议头的信任来源，多个用逗号分隔，不填不信任任何来源，接收PROXY协议头时必须填写 (format \"10.0.0.0/8,192.168.1.1\")")
 )
 
 var (
-	fFromLocal = flag.String("FromLocal", "0.0.0.0", "转发请求的源地址")
-	fToRemote  = flag.String("ToRemote", "", "转发请求的目地址 (format \"22.23.24.25:234\")")
-	fBVerify   = flag.String("BVerify", "", "转发端的验证字符串，转发端发去出的验证数据头。")
+	fFromLocal  = flag.String("FromLocal", "0.0.0.0", "转发请求的源地址")
+	fToRemote   = flag.String("ToRemote", "", "转发请求的目地址，多个地址用逗号分隔，#号后面是权重 (format \"22.23.24.25:234,22.23.24.26:234#2\")")
+	fSNIRoute   = flag.String("SNIRoute", "", "按TLS的SNI和ALPN选择目地址，不解密TLS，没有匹配的使用 ToRemote。多条用分号分隔，/号后面是ALPN (format \"a.example.com=22.23.24.25:443;*.example.com/h2=22.23.24.26:443,22.23.24.27:443\")")
+	fHTTPRoute  = flag.String("HTTPRoute", "", "按HTTP/1.x请求的Host选择目地址，没有匹配的使用 ToRemote。多条用分号分隔 (format \"a.example.com=22.23.24.25:80;*.example.com=22.23.24.26:80,22.23.24.27:80\")")
+	fMuxRoute   = flag.String("MuxRoute", "", "按最先发送的数据识别协议选择目地址，没有匹配的使用 ToRemote。多条用分号分隔，协议：ssh, tls, http, socks5, openvpn, prefix:前缀, regexp:正则, timeout 客户端没有发送数据 (format \"ssh=22.23.24.25:22;tls=22.23.24.26:443;timeout=22.23.24.27:25\")")
+	fMuxTimeout = flag.String("MuxTimeout", "2s", "识别协议读取数据超时。单位：ns, us, ms, s, m, h")
+	fBalance    = flag.String("Balance", "rr", "多个目地址的负载均衡策略：rr 轮询, wrr 加权轮询, leastconn 最少连接, random 随机, hash 按客户端IP哈希, failover 主备（第一个为主其它为备）")
+	fBVerify    = flag.String("BVerify", "", "转发端的验证字符串，转发端发去出的验证数据头。")
+
+	fXForwardedFor   = flag.String("XForwardedFor", "", "在HTTP请求中加入 X-Forwarded-For：append 追加客户端IP, replace 替换为客户端IP")
+	fXForwardedProto = flag.String("XForwardedProto", "", "在HTTP请求中设置 X-Forwarded-Proto (format \"https\")")
+
+	fRemoteTLS           = flag.Bool("RemoteTLS", false, "向目地址发起TLS连接")
+	fRemoteTLSServerName = flag.String("RemoteTLSServerName", "", "目地址证书的主机名，不填使用目地址")
+	fRemoteTLSCA         = flag.String("RemoteTLSCA", "", "目地址CA证书文件，不填使用系统CA")
+	fRemoteTLSCert       = flag.String("RemoteTLSCert", "", "向目地址出示的客户端证书文件")
+	fRemoteTLSKey        = flag.String("RemoteTLSKey", "", "向目地址出示的客户端私钥文件")
+	fRemoteTLSPin        = flag.String("RemoteTLSPin", "", "目地址证书公钥SHA256哈希(base64)，多个用逗号分隔，不填CA时只校验公钥")
 )
 
 var (
 	fTimeout     = flag.String("Timeout", "5s", "请求远程连接超时。单位：ns, us, ms, s, m, h")
 	fMaxConn     = flag.Int("MaxConn", 0, "限制连接最大的数量")
 	fReadBufSize = flag.Int("ReadBufSize", 4096, "交换数据缓冲大小。单位：字节")
+	fPerIPConn   = flag.Int("PerIPConn", 0, "限制单个IP并发连接数量")
+	fPerIPRate   = flag.Float64("PerIPRate", 0, "限制单个IP每秒新建连接数量")
+	fConnRate    = flag.Float64("ConnRate", 0, "限制每秒新建连接数量")
+	fProxyProto  = flag.Int("ProxyProtocol", 0, "向远程发送PROXY协议头，携带客户端地址。1 文本格式，2 二进制格式，0 不发送")
+	fHealthCheck = flag.String("HealthCheck", "0s", "远程健康检查间隔，0s 不检查。单位：ns, us, ms, s, m, h")
+
+	fUDPIdleTimeout = flag.String("UDPIdleTimeout", "60s", "UDP会话空闲超时，双方都没有数据时关闭会话。单位：ns, us, ms, s, m, h")
+	fUDPMaxSessions = flag.Int("UDPMaxSessions", 0, "UDP最大会话数量，超过时关闭最久没有使用的会话，0 不限制")
+	fUDPReply       = flag.String("UDPReply", "connected", "UDP接收回应的来源：connected 只接收目地址, sameip 目地址IP的任意端口, any 任意来源")
+	fUDPOverTCP     = flag.Bool("UDPOverTCP", false, "UDP通过TCP转发，数据报前面加上2字节长度。-Network udp 时目地址是TCP，-Network tcp 时目地址是UDP")
+
+	fHalfCloseTimeout = flag.String("HalfCloseTimeout", "30s", "一方结束后半关闭另一方，等待另一方向结束的时间，超时关闭双方。-1s 不半关闭。单位：ns, us, ms, s, m, h")
+
+	fRateLimitConn    = flag.String("RateLimitConn", "0", "每个连接的带宽，上行为客户端发往远程，格式 上行,下行，只有一个值时上行和下行相同。单位：字节/秒，可以加上 K, M, G。0 不限制")
+	fRateLimitIP      = flag.String("RateLimitIP", "0", "每个来源IP的带宽，格式同 -RateLimitConn")
+	fRateLimitSwap    = flag.String("RateLimitSwap", "0", "全部连接共用的带宽，格式同 -RateLimitConn")
+	fRateLimitProcess = flag.String("RateLimitProcess", "0", "进程内全部连接共用的带宽，格式同 -RateLimitConn")
+	fRateLimitPackets = flag.String("RateLimitPackets", "0", "UDP每个会话每秒的数据报数量，格式 上行,下行。0 不限制")
+
+	fMetricsListen = flag.String("MetricsListen", "", "指标监听地址，在 /metrics 输出Prometheus文本格式的统计 (format \"127.0.0.1:9100\")")
+	fMetricsName   = flag.String("MetricsName", "", "规则名称，用于指标的 rule 标签和日志的 rule 字段，不填使用监听地址")
+
+	fLogLevel  = flag.String("LogLevel", "info", "日志级别：debug, info, warn, error")
+	fLogFormat = flag.String("LogFormat", "text", "日志格式：text 文本, json 每行一个JSON对象")
 )
 
+// 读取验证数据超时
+const verifyTimeout = 10 * time.Second
+
 //commandline:l2d-main.exe -Listen 127.0.0.1:1201 -ToRemote 127.0.0.1:1202 -Network tcp
 func main() {
 	flag.Parse()
@@ -49,10 +104,83 @@ func main() {
 		return
 	}
 
-	var (
-		listen = vforward.Addr{Network: *fNetwork}
-		dial   = vforward.Addr{Network: *fNetwork, Local: &net.TCPAddr{IP: net.ParseIP(*fFromLocal), Port: 0}}
-	)
+	// 日志和规则名称
+	level, err := vforward.ParseLogLevel(*fLogLevel)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var logger vforward.Logger
+	switch *fLogFormat {
+	case "text":
+		logger = vforward.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), level)
+	case "json":
+		logger = vforward.NewJSONLogger(os.Stderr, level)
+	default:
+		log.Printf("日志格式 %q 是未知的，仅支持：text, json", *fLogFormat)
+		return
+	}
+	name := *fMetricsName
+	if name == "" {
+		name = *fListen
+	}
+
+	balances := map[string]vforward.Balance{
+		"rr":        vforward.BalanceRoundRobin,
+		"wrr":       vforward.BalanceWeightRoundRobin,
+		"leastconn": vforward.BalanceLeastConn,
+		"random":    vforward.BalanceRandom,
+		"hash":      vforward.BalanceHash,
+		"failover":  vforward.BalanceFailover,
+	}
+	balance, ok := balances[*fBalance]
+	if !ok {
+		log.Printf("负载均衡策略 %q 是未知的", *fBalance)
+		return
+	}
+
+	// UDP通过TCP转发时，目地址的网络类型与监听相反
+	remoteNetwork := *fNetwork
+	if *fUDPOverTCP {
+		if strings.HasPrefix(remoteNetwork, "udp") {
+			remoteNetwork = "tcp" + remoteNetwork[3:]
+		} else if strings.HasPrefix(remoteNetwork, "tcp") {
+			remoteNetwork = "udp" + remoteNetwork[3:]
+		}
+	}
+
+	listen := vforward.Addr{Network: *fNetwork}
+	parseRemotes := func(vs string) (*vforward.Remotes, error) {
+		var remotes []*vforward.Remote
+		for _, v := range strings.Split(vs, ",") {
+			remote := &vforward.Remote{
+				Addr: &vforward.Addr{Network: remoteNetwork, Local: &net.TCPAddr{IP: net.ParseIP(*fFromLocal), Port: 0}},
+			}
+			var err error
+			if i := strings.LastIndex(v, "#"); i != -1 {
+				if remote.Weight, err = strconv.Atoi(v[i+1:]); err != nil {
+					return nil, err
+				}
+				v = v[:i]
+			}
+			switch remoteNetwork {
+			case "tcp", "tcp4", "tcp6":
+				remote.Remote, err = net.ResolveTCPAddr(remoteNetwork, strings.TrimSpace(v))
+			case "udp", "udp4", "udp6":
+				remote.Remote, err = net.ResolveUDPAddr(remoteNetwork, strings.TrimSpace(v))
+			}
+			if err != nil {
+				return nil, err
+			}
+			remotes = append(remotes, remote)
+		}
+		return vforward.NewRemotes(balance, remotes...), nil
+	}
+	remotes, err := parseRemotes(*fToRemote)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	switch *fNetwork {
 	case "tcp", "tcp4", "tcp6":
 		listen.Local, err = net.ResolveTCPAddr(*fNetwork, *fListen)
@@ -60,35 +188,256 @@ func main() {
 			log.Println(err)
 			return
 		}
-		dial.Remote, err = net.ResolveTCPAddr(*fNetwork, *fToRemote)
+	case "udp", "udp4", "udp6":
+		listen.Local, err = net.ResolveUDPAddr(*fNetwork, *fListen)
 		if err != nil {
 			log.Println(err)
 			return
 		}
-	case "udp", "udp4", "udp6":
-		listen.Local, err = net.ResolveUDPAddr(*fNetwork, *fListen)
+	default:
+		log.Printf("网络地址类型  %q 是未知的，日前仅支持：tcp/tcp4/tcp6, upd/udp4/udp6", *fNetwork)
+		return
+	}
+
+	ld := new(vforward.L2D)
+	ld.Logger = logger
+	ld.Name = name
+
+	// 发起连接超时
+	if ld.Timeout, err = time.ParseDuration(*fTimeout); err != nil {
+		log.Println(err)
+		return
+	}
+	// 半关闭超时
+	if ld.HalfCloseTimeout, err = time.ParseDuration(*fHalfCloseTimeout); err != nil {
+		log.Println(err)
+		return
+	}
+	// UDP会话空闲超时
+	if ld.UDPIdleTimeout, err = time.ParseDuration(*fUDPIdleTimeout); err != nil {
+		log.Println(err)
+		return
+	}
+	ld.UDPMaxSessions = *fUDPMaxSessions // UDP最大会话数量
+	ld.UDPOverTCP = *fUDPOverTCP         // UDP通过TCP转发
+
+	// UDP接收回应的来源
+	switch *fUDPReply {
+	case "connected":
+	case "sameip":
+		ld.UDPReply = vforward.UDPReplySameIP
+	case "any":
+		ld.UDPReply = vforward.UDPReplyAny
+	default:
+		log.Printf("UDP接收回应的来源 %q 是未知的，仅支持：connected, sameip, any", *fUDPReply)
+		return
+	}
+
+	ld.ReadBufSize = *fReadBufSize  // 交换数据缓冲大小
+	ld.ProxyProtocol = *fProxyProto // PROXY协议头
+
+	// 连接限制
+	if *fPerIPConn > 0 || *fPerIPRate > 0 || *fConnRate > 0 {
+		ld.Limit = &vforward.ConnLimit{PerIPConn: *fPerIPConn, PerIPRate: *fPerIPRate, Rate: *fConnRate}
+	}
+
+	// 带宽限制
+	rate := new(vforward.RateLimit)
+	limited := false
+	for _, r := range []struct {
+		s   string
+		set func(up, down float64)
+	}{
+		{*fRateLimitConn, rate.SetConn},
+		{*fRateLimitIP, rate.SetIP},
+		{*fRateLimitSwap, rate.SetSwap},
+		{*fRateLimitPackets, rate.SetPackets},
+		{*fRateLimitProcess, vforward.SetProcessRate},
+	} {
+		up, down, err := vforward.ParseRate(r.s)
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		dial.Remote, err = net.ResolveUDPAddr(*fNetwork, *fToRemote)
+		r.set(up, down)
+		limited = limited || up > 0 || down > 0
+	}
+	if limited {
+		ld.RateLimit = rate
+	}
+
+	// 监听端TLS
+	if *fTLSCert != "" {
+		cf, err := vforward.LoadCertFile(*fTLSCert, *fTLSKey)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		ld.TLSConfig = cf.TLSConfig()
+		if *fTLSClientCA != "" {
+			pool, err := vforward.LoadCertPool(*fTLSClientCA)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			ld.TLSConfig = cf.MutualTLSConfig(pool)
+		}
+	}
+	if *fIdentity != "" {
+		if ld.Identity, err = vforward.LoadIdentityMap(*fIdentity); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	// 转发端TLS
+	if *fRemoteTLS {
+		var pins []string
+		if *fRemoteTLSPin != "" {
+			pins = strings.Split(*fRemoteTLSPin, ",")
+		}
+		ld.RemoteTLS, err = vforward.NewTLSClientConfig(*fRemoteTLSServerName, *fRemoteTLSCA, *fRemoteTLSCert, *fRemoteTLSKey, pins...)
 		if err != nil {
 			log.Println(err)
 			return
 		}
+	}
+
+	// 接收PROXY协议头
+	switch *fProxyAccept {
+	case "":
+	case "on", "strict":
+		if *fProxyTrusted == "" {
+			log.Println("接收PROXY协议头时必须填写 ProxyTrusted 信任来源")
+			return
+		}
+		ld.ProxyAccept = &vforward.ProxyAccept{Strict: *fProxyAccept == "strict", Trusted: new(vforward.ACL)}
+		for _, cidr := range strings.Split(*fProxyTrusted, ",") {
+			if err = ld.ProxyAccept.Trusted.Allow(strings.TrimSpace(cidr)); err != nil {
+				log.Println(err)
+				return
+			}
+		}
 	default:
-		log.Printf("网络地址类型  %q 是未知的，日前仅支持：tcp/tcp4/tcp6, upd/udp4/udp6", *fNetwork)
+		log.Printf("PROXY协议接收方式 %q 是未知的", *fProxyAccept)
 		return
 	}
 
-	ld := new(vforward.L2D)
+	// 路由
+	parseRoutes := func(v string, add func(host string, rs *vforward.Remotes, alpn ...string)) error {
+		for _, route := range strings.Split(v, ";") {
+			i := strings.Index(route, "=")
+			if i == -1 {
+				return fmt.Errorf("路由 %q 格式错误", route)
+			}
+			rs, err := parseRemotes(route[i+1:])
+			if err != nil {
+				return err
+			}
+			var alpn []string
+			host := strings.TrimSpace(route[:i])
+			if j := strings.Index(host, "/"); j != -1 {
+				alpn = strings.Split(host[j+1:], "/")
+				host = host[:j]
+			}
+			add(host, rs, alpn...)
+		}
+		return nil
+	}
+	if *fSNIRoute != "" {
+		router := &vforward.SNIRouter{Default: remotes}
+		if err = parseRoutes(*fSNIRoute, router.Add); err != nil {
+			log.Println(err)
+			return
+		}
+		ld.Router = router
+	}
+	if *fHTTPRoute != "" || *fXForwardedFor != "" || *fXForwardedProto != "" {
+		router := &vforward.HTTPRouter{Default: remotes, XForwardedProto: *fXForwardedProto}
+		switch *fXForwardedFor {
+		case "":
+		case "append":
+			router.XForwardedFor = vforward.ForwardedAppend
+		case "replace":
+			router.XForwardedFor = vforward.ForwardedReplace
+		default:
+			log.Printf("X-Forwarded-For 修改方式 %q 是未知的", *fXForwardedFor)
+			return
+		}
+		if *fHTTPRoute != "" {
+			err = parseRoutes(*fHTTPRoute, func(host string, rs *vforward.Remotes, alpn ...string) {
+				router.Add(host, rs)
+			})
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		if ld.Router != nil {
+			log.Println("SNIRoute 不能和 HTTPRoute，XForwardedFor，XForwardedProto 同时使用")
+			return
+		}
+		ld.Router = router
+	}
+	if *fMuxRoute != "" {
+		if ld.Router != nil {
+			log.Println("MuxRoute 不能和 SNIRoute，HTTPRoute 同时使用")
+			return
+		}
+		router := &vforward.MuxRouter{Default: remotes}
+		if router.Timeout, err = time.ParseDuration(*fMuxTimeout); err != nil {
+			log.Println(err)
+			return
+		}
+		for _, route := range strings.Split(*fMuxRoute, ";") {
+			// 正则中可能有等号，地址中没有
+			i := strings.LastIndex(route, "=")
+			if i == -1 {
+				log.Printf("路由 %q 格式错误", route)
+				return
+			}
+			rs, err := parseRemotes(route[i+1:])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			switch name := strings.TrimSpace(route[:i]); {
+			case name == "timeout":
+				router.OnTimeout = rs
+			case strings.HasPrefix(name, "prefix:"):
+				router.AddPrefix([]byte(name[len("prefix:"):]), rs)
+			case strings.HasPrefix(name, "regexp:"):
+				re, err := regexp.Compile(name[len("regexp:"):])
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				router.AddRegexp(re, rs)
+			default:
+				if err = router.Add(name, rs); err != nil {
+					log.Println(err)
+					return
+				}
+			}
+		}
+		ld.Router = router
+	}
 
-	// 发起连接超时
-	if ld.Timeout, err = time.ParseDuration(*fTimeout); err != nil {
+	// 访问控制
+	if *fACL != "" {
+		if ld.ACL, err = vforward.LoadACL(*fACL); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	// 远程健康检查
+	if d, err := time.ParseDuration(*fHealthCheck); err != nil {
 		log.Println(err)
 		return
+	} else if d > 0 {
+		ld.HealthCheck = &vforward.HealthCheck{Interval: d}
 	}
-	ld.ReadBufSize = *fReadBufSize // 交换数据缓冲大小
 	ld.MaxConn(*fMaxConn)
 
 	oa := func(v string) [][]byte {
@@ -103,10 +452,12 @@ func main() {
 		if v != "" {
 			vs := oa(v)
 
+			conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+			defer conn.SetReadDeadline(time.Time{})
 			p := make([]byte, len(vs[0]))
 			if n, err := conn.Read(p); err != nil || !bytes.Equal(p[:n], vs[0]) {
 				conn.Close()
-				fmt.Printf("verify error, %s != %s \n", v, p[:n])
+				logger.Log(vforward.LevelWarn, "验证数据错误", "rule", name, "remote", conn.RemoteAddr(), "size", n)
 				return false
 			}
 
@@ -127,10 +478,12 @@ func main() {
 				return false
 			}
 
+			conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+			defer conn.SetReadDeadline(time.Time{})
 			p := make([]byte, len(vs[1]))
 			if n, err := conn.Read(p); err != nil || !bytes.Equal(p[:n], vs[1]) {
 				conn.Close()
-				fmt.Printf("verify error, %s != %s \n", v, p[:n])
+				logger.Log(vforward.LevelWarn, "验证数据错误", "rule", name, "remote", conn.RemoteAddr(), "size", n)
 				return false
 			}
 		}
@@ -138,13 +491,29 @@ func main() {
 	})
 
 	defer ld.Close()
-	lds, err := ld.Transport(&listen, &dial)
+	lds, err := ld.TransportRemotes(&listen, remotes)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	defer lds.Close()
+
+	// 指标
+	if *fMetricsListen != "" {
+		ml, err := net.Listen("tcp", *fMetricsListen)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer ml.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", vforward.MetricsHandler(func() map[string]vforward.Stats {
+			return map[string]vforward.Stats{name: lds.Stats()}
+		}))
+		go http.Serve(ml, mux)
+	}
+
 	if err = lds.Swap(); err != nil {
 		log.Printf("错误：%s\n", err)
 	}
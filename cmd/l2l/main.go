@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/456vv/vforward"
@@ -15,8 +19,22 @@ var (
 	fNetwork = flag.String("Network", "tcp", "网络地址类型")
 	fALocal  = flag.String("ALocal", "", "A本地监听网卡IP地址 (format \"12.13.14.15:123\")")
 	fAVerify = flag.String("AVerify", "", "A的验证字符串，桥接后客户端发来的验证数据头。")
+	fAACL    = flag.String("AACL", "", "A的访问控制文件，每行一条规则 (format \"allow 10.0.0.0/8\", \"deny all\")")
 	fBLocal  = flag.String("BLocal", "", "B本地监听网卡IP地址 (format \"22.23.24.25:234\")")
 	fBVerify = flag.String("BVerify", "", "B的验证字符串，桥接后客户端发来的验证数据头。")
+	fBACL    = flag.String("BACL", "", "B的访问控制文件，每行一条规则 (format \"allow 10.0.0.0/8\", \"deny all\")")
+
+	fAProxyAccept = flag.String("AProxyAccept", "", "A接收PROXY协议头：on 接收, strict 严格模式，拒绝非信任来源和没有发送协议头的连接")
+	fBProxyAccept = flag.String("BProxyAccept", "", "B接收PROXY协议头：on 接收, strict 严格模式，拒绝非信任来源和没有发送协议头的连接")
+	fATLSCert     = flag.String("ATLSCert", "", "A的TLS证书文件，文件修改后自动重新加载")
+	fATLSKey      = flag.String("ATLSKey", "", "A的TLS私钥文件")
+	fBTLSCert     = flag.String("BTLSCert", "", "B的TLS证书文件，文件修改后自动重新加载")
+	fBTLSKey      = flag.String("BTLSKey", "", "B的TLS私钥文件")
+	fATLSClientCA = flag.String("ATLSClientCA", "", "A的客户端CA证书文件，填写后客户端必须出示由该CA签发的证书")
+	fBTLSClientCA = flag.String("BTLSClientCA", "", "B的客户端CA证书文件，填写后客户端必须出示由该CA签发的证书")
+	fAIdentity    = flag.String("AIdentity", "", "A的客户端证书身份映射文件，每行一条 (format \"client1.example.com client1\")，没有对应身份的证书被拒绝")
+	fBIdentity    = flag.String("BIdentity", "", "B的客户端证书身份映射文件，每行一条 (format \"client1.example.com client1\")，没有对应身份的证书被拒绝")
+	fProxyTrusted = flag.String("ProxyTrusted", "", "PROXY协议头的信任来源，多个用逗号分隔，不填不信任任何来源，接收PROXY协议头时必须填写 (format \"10.0.0.0/8,192.168.1.1\")")
 )
 
 var (
@@ -24,8 +42,31 @@ var (
 	fKeptIdeConn = flag.Int("KeptIdeConn", 2, "保持一方连接数量，以备快速互相连接。")
 	fIdeTimeout  = flag.String("IdeTimeout", "0s", "空闲连接超时。单位：ns, us, ms, s, m, h")
 	fReadBufSize = flag.Int("ReadBufSize", 4096, "交换数据缓冲大小。单位：字节")
+	fPerIPConn   = flag.Int("PerIPConn", 0, "限制单个IP并发连接数量")
+	fPerIPRate   = flag.Float64("PerIPRate", 0, "限制单个IP每秒新建连接数量")
+	fConnRate    = flag.Float64("ConnRate", 0, "限制每秒新建连接数量")
+	fProxyProto  = flag.Int("ProxyProtocol", 0, "配对后向B方发送PROXY协议头，携带A方客户端地址。1 文本格式，2 二进制格式，0 不发送")
+
+	fRUDPWindow       = flag.Int("RUDPWindow", 128, "可靠UDP的发送和接收窗口。单位：段")
+	fRUDPNoCongestion = flag.Bool("RUDPNoCongestion", false, "可靠UDP关闭拥塞控制，只受窗口限制")
+
+	fHalfCloseTimeout = flag.String("HalfCloseTimeout", "30s", "一方结束后半关闭另一方，等待另一方向结束的时间，超时关闭双方。-1s 不半关闭。单位：ns, us, ms, s, m, h")
+
+	fRateLimitConn    = flag.String("RateLimitConn", "0", "每个连接的带宽，上行为A发往B，格式 上行,下行，只有一个值时上行和下行相同。单位：字节/秒，可以加上 K, M, G。0 不限制")
+	fRateLimitIP      = flag.String("RateLimitIP", "0", "每个来源IP的带宽，格式同 -RateLimitConn")
+	fRateLimitSwap    = flag.String("RateLimitSwap", "0", "全部连接共用的带宽，格式同 -RateLimitConn")
+	fRateLimitProcess = flag.String("RateLimitProcess", "0", "进程内全部连接共用的带宽，格式同 -RateLimitConn")
+
+	fMetricsListen = flag.String("MetricsListen", "", "指标监听地址，在 /metrics 输出Prometheus文本格式的统计 (format \"127.0.0.1:9100\")")
+	fMetricsName   = flag.String("MetricsName", "", "规则名称，用于指标的 rule 标签和日志的 rule 字段，不填使用A监听地址-B监听地址")
+
+	fLogLevel  = flag.String("LogLevel", "info", "日志级别：debug, info, warn, error")
+	fLogFormat = flag.String("LogFormat", "text", "日志格式：text 文本, json 每行一个JSON对象")
 )
 
+// 读取验证数据超时
+const verifyTimeout = 10 * time.Second
+
 //commandline:l2l-main.exe -ALocal 127.0.0.1:1201 -BLocal 127.0.0.1:1202 -Network tcp
 func main() {
 	flag.Parse()
@@ -44,19 +85,49 @@ func main() {
 		log.Printf("地址未填，A监听地址 %q, B监听地址 %q", *fALocal, *fBLocal)
 		return
 	}
+
+	// 日志和规则名称
+	level, err := vforward.ParseLogLevel(*fLogLevel)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var logger vforward.Logger
+	switch *fLogFormat {
+	case "text":
+		logger = vforward.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), level)
+	case "json":
+		logger = vforward.NewJSONLogger(os.Stderr, level)
+	default:
+		log.Printf("日志格式 %q 是未知的，仅支持：text, json", *fLogFormat)
+		return
+	}
+	name := *fMetricsName
+	if name == "" {
+		name = *fALocal + "-" + *fBLocal
+	}
+	var resolve func(address string) (net.Addr, error)
 	switch *fNetwork {
 	case "tcp", "tcp4", "tcp6":
+		resolve = func(address string) (net.Addr, error) {
+			return net.ResolveTCPAddr(*fNetwork, address)
+		}
+	case "rudp", "rudp4", "rudp6":
+		// 可靠UDP
+		resolve = func(address string) (net.Addr, error) {
+			return net.ResolveUDPAddr(strings.TrimPrefix(*fNetwork, "r"), address)
+		}
 	default:
-		log.Printf("网络地址类型  %q 是未知的，日前仅支持：tcp/tcp4/tcp6", *fNetwork)
+		log.Printf("网络地址类型  %q 是未知的，日前仅支持：tcp/tcp4/tcp6 或 rudp/rudp4/rudp6", *fNetwork)
 		return
 	}
 
-	addr1, err := net.ResolveTCPAddr(*fNetwork, *fALocal)
+	addr1, err := resolve(*fALocal)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	addr2, err := net.ResolveTCPAddr(*fNetwork, *fBLocal)
+	addr2, err := resolve(*fBLocal)
 	if err != nil {
 		log.Println(err)
 		return
@@ -71,6 +142,8 @@ func main() {
 	}
 
 	ll := new(vforward.L2L)
+	ll.Logger = logger
+	ll.Name = name
 	// 空闲连接超时
 	d, err := time.ParseDuration(*fIdeTimeout)
 	if err != nil {
@@ -80,7 +153,146 @@ func main() {
 	ll.IdeTimeout(d)
 	ll.MaxConn(*fMaxConn)
 	ll.KeptIdeConn(*fKeptIdeConn)
-	ll.ReadBufSize = *fReadBufSize // 交换数据缓冲大小
+	// 半关闭超时
+	if ll.HalfCloseTimeout, err = time.ParseDuration(*fHalfCloseTimeout); err != nil {
+		log.Println(err)
+		return
+	}
+	ll.ReadBufSize = *fReadBufSize  // 交换数据缓冲大小
+	ll.ProxyProtocol = *fProxyProto // PROXY协议头
+	ll.RUDP = &vforward.RUDPConfig{SendWindow: *fRUDPWindow, RecvWindow: *fRUDPWindow, NoCongestion: *fRUDPNoCongestion}
+
+	// 连接限制
+	if *fPerIPConn > 0 || *fPerIPRate > 0 || *fConnRate > 0 {
+		ll.Limit = &vforward.ConnLimit{PerIPConn: *fPerIPConn, PerIPRate: *fPerIPRate, Rate: *fConnRate}
+	}
+
+	// 带宽限制
+	rate := new(vforward.RateLimit)
+	limited := false
+	for _, r := range []struct {
+		s   string
+		set func(up, down float64)
+	}{
+		{*fRateLimitConn, rate.SetConn},
+		{*fRateLimitIP, rate.SetIP},
+		{*fRateLimitSwap, rate.SetSwap},
+		{*fRateLimitProcess, vforward.SetProcessRate},
+	} {
+		up, down, err := vforward.ParseRate(r.s)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		r.set(up, down)
+		limited = limited || up > 0 || down > 0
+	}
+	if limited {
+		ll.RateLimit = rate
+	}
+
+	// 访问控制
+	loadACL := func(file string) (*vforward.ACL, error) {
+		if file == "" {
+			return nil, nil
+		}
+		return vforward.LoadACL(file)
+	}
+	aacl, err := loadACL(*fAACL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	bacl, err := loadACL(*fBACL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ll.ACL(aacl, bacl)
+
+	// TLS
+	tlsConfig := func(certFile, keyFile, clientCA string) (*tls.Config, error) {
+		if certFile == "" {
+			return nil, nil
+		}
+		cf, err := vforward.LoadCertFile(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if clientCA != "" {
+			pool, err := vforward.LoadCertPool(clientCA)
+			if err != nil {
+				return nil, err
+			}
+			return cf.MutualTLSConfig(pool), nil
+		}
+		return cf.TLSConfig(), nil
+	}
+	atls, err := tlsConfig(*fATLSCert, *fATLSKey, *fATLSClientCA)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	btls, err := tlsConfig(*fBTLSCert, *fBTLSKey, *fBTLSClientCA)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ll.TLSConfig(atls, btls)
+
+	// 客户端证书身份映射
+	loadIdentity := func(file string) (*vforward.IdentityMap, error) {
+		if file == "" {
+			return nil, nil
+		}
+		return vforward.LoadIdentityMap(file)
+	}
+	aid, err := loadIdentity(*fAIdentity)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	bid, err := loadIdentity(*fBIdentity)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ll.Identity(aid, bid)
+
+	// 接收PROXY协议头
+	var trusted *vforward.ACL
+	if *fProxyTrusted != "" {
+		trusted = new(vforward.ACL)
+		for _, cidr := range strings.Split(*fProxyTrusted, ",") {
+			if err = trusted.Allow(strings.TrimSpace(cidr)); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+	proxyAccept := func(v string) (*vforward.ProxyAccept, error) {
+		switch v {
+		case "":
+			return nil, nil
+		case "on", "strict":
+			if trusted == nil {
+				return nil, fmt.Errorf("接收PROXY协议头时必须填写 ProxyTrusted 信任来源")
+			}
+			return &vforward.ProxyAccept{Trusted: trusted, Strict: v == "strict"}, nil
+		}
+		return nil, fmt.Errorf("PROXY协议接收方式 %q 是未知的", v)
+	}
+	apa, err := proxyAccept(*fAProxyAccept)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	bpa, err := proxyAccept(*fBProxyAccept)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ll.ProxyAccept(apa, bpa)
 
 	oa := func(v string) [][]byte {
 		vs := bytes.SplitN([]byte(v), []byte("|"), 2)
@@ -93,10 +305,12 @@ func main() {
 		if v != "" {
 			vs := oa(v)
 
+			conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+			defer conn.SetReadDeadline(time.Time{})
 			p := make([]byte, len(vs[0]))
 			if n, err := conn.Read(p); err != nil || !bytes.Equal(p[:n], vs[0]) {
 				conn.Close()
-				fmt.Printf("verify error, %s != %s \n", v, p[:n])
+				logger.Log(vforward.LevelWarn, "验证数据错误", "rule", name, "remote", conn.RemoteAddr(), "size", n)
 				return false
 			}
 
@@ -122,6 +336,22 @@ func main() {
 	}
 
 	defer lls.Close()
+
+	// 指标
+	if *fMetricsListen != "" {
+		ml, err := net.Listen("tcp", *fMetricsListen)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer ml.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", vforward.MetricsHandler(func() map[string]vforward.Stats {
+			return map[string]vforward.Stats{name: lls.Stats()}
+		}))
+		go http.Serve(ml, mux)
+	}
+
 	if err = lls.Swap(); err != nil {
 		log.Printf("错误：%s\n", err)
 	}
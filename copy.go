@@ -0,0 +1,92 @@
+package vforward
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/456vv/vconnpool/v2"
+)
+
+// 交换数据缓冲池，缓冲小于需要的大小时丢弃
+var copyBufs sync.Pool
+
+func getCopyBuf(size int) *[]byte {
+	if buf, ok := copyBufs.Get().(*[]byte); ok && cap(*buf) >= size {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+func putCopyBuf(buf *[]byte) {
+	copyBufs.Put(buf)
+}
+
+// copyConn 从 src 复制数据到 dst，直到 src 读取结束。
+// 双方可以跳过包装得到TCP或Unix连接时，在Linux上使用 splice 零拷贝，否则使用缓冲池复制
+//
+//	dst, src net.Conn   写入方，读取方
+//	bufferSize int      缓冲大小
+//	count *int64        实时累加复制的字节数
+//	int64               复制的字节数
+//	error               错误，读取结束时为 nil
+func copyConn(dst, src net.Conn, bufferSize int, count *int64) (int64, error) {
+	if n, handled, err := spliceConn(dst, src, count); handled {
+		return n, err
+	}
+	buf := getCopyBuf(bufferSize)
+	defer putCopyBuf(buf)
+
+	var written int64
+	for {
+		nr, rerr := src.Read(*buf)
+		if nr > 0 {
+			nw, werr := dst.Write((*buf)[:nr])
+			written += int64(nw)
+			atomic.AddInt64(count, int64(nw))
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// directConn 跳过不改变数据的包装，返回原连接。
+// read 为 true 时还返回包装中已读取还没有返回的字节数，写入方不能统计，另一方向可能正在读取
+func directConn(conn net.Conn, read bool) (net.Conn, int) {
+	buffered := 0
+	for {
+		switch c := conn.(type) {
+		case *limitConn:
+			conn = c.Conn
+		case *identityConn:
+			conn = c.Conn
+		case *peekConn:
+			if read {
+				buffered += c.r.Buffered()
+			}
+			conn = c.Conn
+		case *proxyConn:
+			if read {
+				buffered += c.r.Buffered()
+			}
+			conn = c.Conn
+		case vconnpool.Conn:
+			conn = c.RawConn()
+		default:
+			return conn, buffered
+		}
+	}
+}
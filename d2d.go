@@ -2,6 +2,7 @@ package vforward
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -21,6 +22,7 @@ type D2DSwap struct {
 	conns  vmap.Map                                        // 连接存储，方便关闭已经连接的连接
 	closed atomicBool                                      // 关闭
 	used   atomicBool                                      // 正在使用中
+	rate   rateScope                                       // 带宽限制
 }
 
 // ConnNum 当前正在转发的连接数量
@@ -103,9 +105,18 @@ func (T *D2DSwap) dataCopy(conna, connb net.Conn) {
 
 	defer atomic.AddInt32(&T.dd.currUseConn, -2)
 
+	// 配对之后结束都通知 OnClose
+	var (
+		s   = T.dd.Hooks.pair(conna.RemoteAddr(), connb.RemoteAddr(), true)
+		n   [2]int64
+		err error
+	)
+	defer func() { T.dd.Hooks.close(s, n, err) }()
+
 	if T.closed.isTrue() {
 		conna.Close()
 		connb.Close()
+		err = errSwapClosed
 		return
 	}
 
@@ -113,22 +124,51 @@ func (T *D2DSwap) dataCopy(conna, connb net.Conn) {
 	T.conns.Set(conna, connb)
 	defer T.conns.Del(conna)
 
+	lg := T.dd.log().with("conn", nextConnID(), "a", conna.RemoteAddr(), "b", connb.RemoteAddr())
+
+	// 向B方发送PROXY协议头，携带A方的地址。池中的连接是预先建立的，配对后才知道A方
+	if T.dd.ProxyProtocol != 0 {
+		if err = writeProxyHeader(connb, T.dd.ProxyProtocol, conna.RemoteAddr(), conna.LocalAddr()); err != nil {
+			lg.warn("发送PROXY协议头失败", "error", err)
+			atomic.AddInt64(&T.dd.stats.failed, 1)
+			conna.Close()
+			connb.Close()
+			return
+		}
+	}
+
 	//----------------------------
-	var err error
 	if T.Verify != nil {
 		conna, connb, err = T.Verify(conna, connb)
 		if err != nil {
-			T.dd.logf("验证失败: %s", err)
+			lg.warn("验证失败", "error", err)
+			atomic.AddInt64(&T.dd.stats.verifyFailed, 1)
 			return
 		}
 	}
 
-	go func() {
-		copyData(conna, connb, bufSize)
-		conna.Close()
-	}()
-	copyData(connb, conna, bufSize)
-	connb.Close()
+	// 带宽限制
+	if rate := T.dd.RateLimit.acquire(conna.RemoteAddr(), &T.rate); rate != nil {
+		defer rate.release()
+		conna, connb = newRateConn(conna, rate, dirUp), newRateConn(connb, rate, dirDown)
+	}
+
+	start := time.Now()
+	n, err = swapData(conna, connb, bufSize, T.dd.HalfCloseTimeout, &T.dd.stats.bytes)
+	atomic.AddInt64(&T.dd.stats.completed, 1)
+	lg.closed(n, start, err)
+}
+
+// Stats 统计快照，可以在其它协程中调用
+//
+//	Stats       统计
+func (T *D2DSwap) Stats() Stats {
+	s := T.dd.stats.snapshot(T.ConnNum())
+	s.Idle = []int{
+		T.dd.acp.ConnNumIde(T.dd.aaddr.Remote.Network(), T.dd.aaddr.Remote.String()),
+		T.dd.bcp.ConnNumIde(T.dd.baddr.Remote.Network(), T.dd.baddr.Remote.String()),
+	}
+	return s
 }
 
 // Close 关闭数据交换 .Swap()，你还可以再次使用 .Swap() 启动。
@@ -158,27 +198,42 @@ func (T *D2DSwap) Close() error {
 //	 |     |  5→  |   |  6→  |     |（3，A内网收到数据再发出数据，由[D2D]转发到B外网。）
 //		-------------------------------------
 type D2D struct {
-	TryConnTime time.Duration   // 尝试或发起连接时间，可能一方不在线，会一直尝试连接对方。(默认：1s)
-	ReadBufSize int             // 交换数据缓冲大小
-	Timeout     time.Duration   // 发起连接超时
-	ErrorLog    *log.Logger     // 日志
-	Context     context.Context // 上下文
+	TryConnTime      time.Duration   // 尝试或发起连接时间，可能一方不在线，会一直尝试连接对方。(默认：1s)
+	ReadBufSize      int             // 交换数据缓冲大小
+	HalfCloseTimeout time.Duration   // 一方结束后半关闭另一方，等待另一方向结束的时间，超时关闭双方。小于0 不半关闭，一方结束即关闭双方（默认：30s）
+	Timeout          time.Duration   // 发起连接超时
+	ErrorLog         *log.Logger     // 日志，没有设置 Logger 时使用，输出信息及以上级别
+	Logger           Logger          // 分级的结构化日志（默认：nil，使用 ErrorLog）
+	Name             string          // 规则名称，日志中的 rule 字段
+	Context          context.Context // 上下文
+	HealthCheck      *HealthCheck    // 远程健康检查，不可用的一方将退避等待恢复（默认：nil，不检查）
+	RUDP             *RUDPConfig     // 网络类型为 rudp, rudp4, rudp6 时的可靠UDP设置（默认：nil，使用默认设置）
+	RateLimit        *RateLimit      // 带宽限制（默认：nil，不限制）
+	Hooks            *Hooks          // 连接生命周期的回调（默认：nil，不回调）
+	ProxyProtocol    int             // 配对后向B方发送PROXY协议头，携带A方的地址，B方需要是TCP。ProxyProtocolV1 或 ProxyProtocolV2，A方是UDP时仅支持v2（默认：0，不发送）
 
 	acp     vconnpool.ConnPool // A方连接池
 	aticker *time.Ticker       // A方心跳时间
 	aaddr   *Addr              // A方连接地址
 	adialer net.Dialer
 	averify func(net.Conn) bool
+	ahealth health      // A方健康状态
+	atls    *tls.Config // A方TLS设置
+	aframe  bool        // A方UDP数据报按帧交换
 
 	bcp     vconnpool.ConnPool // B方连接池
 	bticker *time.Ticker       // B方心跳时间
 	baddr   *Addr              // B方连接地址
 	bdialer net.Dialer
 	bverify func(net.Conn) bool
+	bhealth health      // B方健康状态
+	btls    *tls.Config // B方TLS设置
+	bframe  bool        // B方UDP数据报按帧交换
 
 	backPooling atomicBool // 确保连接回到池中
 
 	currUseConn int32      // 当前使用连接数量
+	stats       *swapStats // 统计
 	closed      atomicBool // 关闭
 	used        atomicBool // 正在使用
 }
@@ -200,10 +255,22 @@ func (T *D2D) init() {
 	}
 
 	T.adialer.Control = reuseport.Control
-	T.acp.Dialer = &T.adialer
+	T.acp.Dialer = &rudpDialer{Dialer: &T.adialer, config: T.RUDP}
+	if T.atls != nil {
+		T.acp.Dialer = &tlsDialer{Dialer: T.acp.Dialer, Config: T.atls}
+	}
+	if T.aframe {
+		T.acp.Dialer = &unframeDialer{Dialer: T.acp.Dialer}
+	}
 
 	T.bdialer.Control = reuseport.Control
-	T.bcp.Dialer = &T.bdialer
+	T.bcp.Dialer = &rudpDialer{Dialer: &T.bdialer, config: T.RUDP}
+	if T.btls != nil {
+		T.bcp.Dialer = &tlsDialer{Dialer: T.bcp.Dialer, Config: T.btls}
+	}
+	if T.bframe {
+		T.bcp.Dialer = &unframeDialer{Dialer: T.bcp.Dialer}
+	}
 }
 
 // 限制连接最大的数量。（默认：500）
@@ -228,16 +295,23 @@ func (T *D2D) IdeTimeout(d time.Duration) {
 	T.bcp.IdeTimeout = d
 }
 
-// Transport 建立连接，支持协议类型："tcp", "tcp4","tcp6", "unix", "unixpacket"。其它还没测试支持："udp", "udp4", "udp6", "ip", "ip4", "ip6", "unixgram"
+// Transport 建立连接，支持协议类型："tcp", "tcp4","tcp6", "unix", "unixpacket"，可靠UDP："rudp", "rudp4", "rudp6"。其它还没测试支持："udp", "udp4", "udp6", "ip", "ip4", "ip6", "unixgram"
 //
 //	a, b *Addr  A，B方地址
 //	*D2DSwap    数据交换
 //	error       错误
 func (T *D2D) Transport(a, b *Addr) (*D2DSwap, error) {
+	if T.ProxyProtocol != 0 && !isStream(b.Network) {
+		return nil, errors.New("vforward: B方不是TCP连接，不能发送PROXY协议头")
+	}
+	if T.ProxyProtocol == ProxyProtocolV1 && !isStream(a.Network) {
+		return nil, errors.New("vforward: PROXY协议v1不支持UDP")
+	}
 	if T.used.setTrue() {
 		return nil, errors.New("vforward: 不能重复调用 D2D.Transport")
 	}
 	T.init()
+	T.stats = new(swapStats)
 
 	tryTime := T.TryConnTime
 	if tryTime == 0 {
@@ -248,13 +322,20 @@ func (T *D2D) Transport(a, b *Addr) (*D2DSwap, error) {
 	T.aaddr = a
 	T.aticker = time.NewTicker(tryTime)
 	T.adialer.LocalAddr = a.Local
-	go T.bufConn(T.aticker, &T.acp, a, &T.averify) // 定时处理连接池
+	go T.bufConn(T.aticker, &T.acp, a, &T.averify, &T.ahealth) // 定时处理连接池
 
 	// B连接
 	T.baddr = b
 	T.bticker = time.NewTicker(tryTime)
 	T.bdialer.LocalAddr = b.Local
-	go T.bufConn(T.bticker, &T.bcp, b, &T.bverify)
+	go T.bufConn(T.bticker, &T.bcp, b, &T.bverify, &T.bhealth)
+
+	if T.HealthCheck != nil {
+		go T.HealthCheck.run(&T.closed, T.log(), func(f func(*health, *Addr)) {
+			f(&T.ahealth, a)
+			f(&T.bhealth, b)
+		})
+	}
 
 	return &D2DSwap{dd: T}, nil
 }
@@ -268,6 +349,24 @@ func (T *D2D) Verify(a func(net.Conn) bool, b func(net.Conn) bool) {
 	T.bverify = b
 }
 
+// TLSConfig 向双方发起TLS连接，握手和证书校验成功后才送入池中，之后 Verify 和交换数据都使用解密后的连接。
+// 需要在 Transport 之前调用。ServerName 为空时使用连接地址的主机名校验证书，见 NewTLSClientConfig
+//
+//	a, b *tls.Config    A，B方TLS设置，nil 不加密
+func (T *D2D) TLSConfig(a, b *tls.Config) {
+	T.atls = a
+	T.btls = b
+}
+
+// UDPOverTCP 一方是UDP，另一方是TCP隧道时，UDP的每个数据报前面加上2字节长度与TCP交换，
+// 对端使用 L2D.UDPOverTCP 还原数据报。需要在 Transport 之前调用。
+//
+//	a, b bool	A，B方是UDP并且按帧交换
+func (T *D2D) UDPOverTCP(a, b bool) {
+	T.aframe = a
+	T.bframe = b
+}
+
 // Close 关闭D2D
 //
 //	error   错误
@@ -297,7 +396,8 @@ func (T *D2D) bGetConn() (net.Conn, error) {
 }
 
 // 缓冲连接，保持可用的连接数量
-func (T *D2D) bufConn(tick *time.Ticker, cp *vconnpool.ConnPool, addr *Addr, verify *func(net.Conn) bool) {
+func (T *D2D) bufConn(tick *time.Ticker, cp *vconnpool.ConnPool, addr *Addr, verify *func(net.Conn) bool, h *health) {
+	var wait time.Duration
 	for {
 		// 程序退出
 		if T.closed.isTrue() {
@@ -310,8 +410,15 @@ func (T *D2D) bufConn(tick *time.Ticker, cp *vconnpool.ConnPool, addr *Addr, ver
 			return
 		}
 
+		// 远程不可用，退避等待健康检查恢复
+		if !h.Healthy() {
+			wait = delay(wait, T.HealthCheck.interval())
+			continue
+		}
+		wait = 0
+
 		if !T.saturation(cp, addr) {
-			go T.examineConn(cp, addr, verify)
+			go T.examineConn(cp, addr, verify, h)
 		}
 	}
 }
@@ -322,7 +429,7 @@ func (T *D2D) saturation(cp *vconnpool.ConnPool, addr *Addr) bool {
 	return T.currUseConns()+cp.ConnNum() >= cp.MaxConn || cp.ConnNumIde(addr.Remote.Network(), addr.Remote.String()) >= cp.IdeConn
 }
 
-func (T *D2D) examineConn(cp *vconnpool.ConnPool, addr *Addr, verify *func(net.Conn) bool) {
+func (T *D2D) examineConn(cp *vconnpool.ConnPool, addr *Addr, verify *func(net.Conn) bool, h *health) {
 	if T.saturation(cp, addr) {
 		return
 	}
@@ -341,18 +448,27 @@ func (T *D2D) examineConn(cp *vconnpool.ConnPool, addr *Addr, verify *func(net.C
 	T.backPooling.setTrue()
 	defer T.backPooling.setFalse()
 	ctx = context.WithValue(ctx, vconnpool.PriorityContextKey, true)
+	start := time.Now()
 	conn, err := cp.DialContext(ctx, addr.Network, addr.Remote.String())
+	T.Hooks.dial(addr.Network, addr.Remote.String(), time.Since(start), err)
 	if err != nil {
-		T.logf("向远程 %s 发起请求失败: %v", addr.Remote.String(), err)
+		T.log().warn("向远程发起连接失败", "target", addr.Remote, "error", err)
+		atomic.AddInt64(&T.stats.failed, 1)
+		T.stats.dialError(err)
+		T.healthFail(h, addr)
 		return
 	}
+	T.stats.dial(time.Since(start))
 
 	conn = conn.(vconnpool.Conn).RawConn() // 不是从池中读取出来的，可以直接转
 	if *verify != nil && !(*verify)(conn) {
-		T.logf("%s 连接验证失败", conn.RemoteAddr().String())
+		T.log().warn("连接验证失败", "target", conn.RemoteAddr())
+		atomic.AddInt64(&T.stats.verifyFailed, 1)
 		conn.Close()
+		T.healthFail(h, addr)
 		return
 	}
+	T.HealthCheck.succeed(h)
 
 	if T.saturation(cp, addr) {
 		conn.Close()
@@ -363,6 +479,13 @@ func (T *D2D) examineConn(cp *vconnpool.ConnPool, addr *Addr, verify *func(net.C
 	}
 }
 
-func (T *D2D) logf(format string, v ...interface{}) {
-	errLog(T.ErrorLog, format, v...)
+// 被动检测，记录远程失败
+func (T *D2D) healthFail(h *health, addr *Addr) {
+	if T.HealthCheck.fail(h) {
+		T.log().warn("远程连续失败，标记为不可用", "target", addr.Remote)
+	}
+}
+
+func (T *D2D) log() logger {
+	return newLogger(T.Logger, T.ErrorLog, T.Name)
 }
@@ -2,9 +2,6 @@ package vforward
 
 import (
 	"errors"
-	"fmt"
-	"io"
-	"log"
 	"net"
 	"strings"
 	"sync/atomic"
@@ -15,6 +12,12 @@ import (
 
 const DefaultReadBufSize int = 4096 // 默认交换数据缓冲大小
 
+// 数据方向，用于带宽限制和统计
+const (
+	dirUp   = 0 // 上行，L2D客户端发往远程，D2D和L2L的A方发往B方
+	dirDown = 1 // 下行，L2D远程回应客户端，D2D和L2L的B方发往A方
+)
+
 // Addr 地址包含本地，远程
 type Addr struct {
 	Network       string
@@ -49,10 +52,76 @@ func delay(wait, maxDelay time.Duration) time.Duration {
 	return wait
 }
 
-func copyData(dst io.Writer, src io.ReadCloser, bufferSize int) (written int64, err error) {
-	defer src.Close()
-	buf := make([]byte, bufferSize)
-	return io.CopyBuffer(dst, src, buf)
+// 半关闭后等待另一方向结束的默认时间
+const DefaultHalfCloseTimeout = 30 * time.Second
+
+// closeWrite 半关闭连接的写入方向，向对方发送FIN。连接不支持半关闭时返回 false
+func closeWrite(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		case interface{ RawConn() net.Conn }:
+			conn = c.RawConn()
+		default:
+			return false
+		}
+	}
+}
+
+// swapData 双方交换数据。一方读取结束后半关闭另一方的写入，继续交换另一方向，
+// 直到另一方向也结束或超过 timeout。出错或连接不支持半关闭时立即关闭双方
+//
+//	a, b net.Conn           双方连接
+//	bufferSize int          交换数据缓冲大小
+//	timeout time.Duration   半关闭超时（0 默认，小于0 不半关闭）
+//	bytes *[2]int64         实时累加的字节数，a 发往 b 为上行
+//	n [2]int64              本次交换的上行，下行字节数
+//	err error               结束交换的错误，正常结束为nil
+func swapData(a, b net.Conn, bufferSize int, timeout time.Duration, bytes *[2]int64) (n [2]int64, err error) {
+	if timeout == 0 {
+		timeout = DefaultHalfCloseTimeout
+	}
+	type result struct {
+		dir    int
+		n      int64
+		err    error
+		closed bool // 已关闭双方
+	}
+	done := make(chan result, 2)
+	copyData := func(dst, src net.Conn, dir int) {
+		n, err := copyConn(dst, src, bufferSize, &bytes[dir])
+		closed := err != nil || timeout < 0 || !closeWrite(dst)
+		if closed {
+			a.Close()
+			b.Close()
+		}
+		done <- result{dir, n, err, closed}
+	}
+	go copyData(b, a, dirUp)
+	go copyData(a, b, dirDown)
+
+	// 关闭双方之前结束的方向才记录错误，之后的错误是关闭引起的
+	r := <-done
+	n[r.dir], err = r.n, r.err
+	pending := 1
+	if !r.closed {
+		timer := time.NewTimer(timeout)
+		select {
+		case r = <-done:
+			n[r.dir], err = r.n, r.err
+			pending = 0
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	a.Close()
+	b.Close()
+	if pending > 0 {
+		r = <-done
+		n[r.dir] = r.n
+	}
+	return n, err
 }
 
 func connectListen(addr *Addr) (interface{}, error) {
@@ -69,6 +138,15 @@ func connectListen(addr *Addr) (interface{}, error) {
 	return nil, errors.New("vforward: 监听地址类型是未知的")
 }
 
+// 面向连接的网络类型
+func isStream(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix", "unixpacket", "rudp", "rudp4", "rudp6":
+		return true
+	}
+	return false
+}
+
 func connectUDP(addr *Addr) (net.Conn, error) {
 	switch addr.Network {
 	case "udp", "udp4", "udp6":
@@ -84,12 +162,3 @@ func connectUDP(addr *Addr) (net.Conn, error) {
 	}
 	return nil, errors.New("vforward: 远程地址类型是未知的")
 }
-
-func errLog(ErrorLog *log.Logger, format string, v ...interface{}) {
-	str := fmt.Sprintf(format+"\n", v...)
-	if ErrorLog != nil {
-		ErrorLog.Output(2, str)
-		return
-	}
-	log.Print(str)
-}
@@ -1,12 +1,33 @@
 package vforward
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math/big"
+	mrand "math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -365,3 +386,2289 @@ func Test_L2L_1(t *testing.T) {
 	time.Sleep(time.Second)
 	as.Equal(birdge.ConnNum(), 0)
 }
+
+// 判断L2L的回调，被拒绝的连接也调用 OnClose
+func Test_L2L_Hooks(t *testing.T) {
+	as := assert.New(t, true)
+
+	var (
+		mu      sync.Mutex
+		accepts []net.Addr
+		pairs   []Session
+	)
+	closes := make(chan Session, 2)
+	hooks := &Hooks{
+		OnAccept: func(local, remote net.Addr) {
+			mu.Lock()
+			defer mu.Unlock()
+			accepts = append(accepts, remote)
+		},
+		OnPair: func(s *Session) {
+			mu.Lock()
+			defer mu.Unlock()
+			pairs = append(pairs, *s)
+		},
+		OnClose: func(s *Session) { closes <- *s },
+	}
+	// 启动L2L，返回A方和B方的监听地址
+	start := func(bacl *ACL) (string, string) {
+		ll := &L2L{Hooks: hooks}
+		ll.KeptIdeConn(1)
+		ll.ACL(nil, bacl)
+		local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}
+		bridge, err := ll.Transport(&Addr{Network: "tcp", Local: local}, &Addr{Network: "tcp", Local: local})
+		as.NotError(err)
+		t.Cleanup(func() { bridge.Close(); ll.Close() })
+		go bridge.Swap()
+		return ll.alisten.Addr().String(), ll.blisten.Addr().String()
+	}
+	wait := func() Session {
+		select {
+		case s := <-closes:
+			return s
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnClose 没有调用")
+		}
+		return Session{}
+	}
+
+	aaddr, baddr := start(nil)
+	conna, err := net.Dial("tcp", aaddr)
+	as.NotError(err)
+	defer conna.Close()
+	connb, err := net.Dial("tcp", baddr)
+	as.NotError(err)
+	defer connb.Close()
+
+	conna.Write([]byte("hello"))
+	connb.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, 5)
+	_, err = io.ReadFull(connb, p)
+	as.NotError(err).Equal(string(p), "hello")
+	conna.Close()
+	connb.Close()
+
+	s := wait()
+	as.Equal(s.A.String(), conna.LocalAddr().String()).Equal(s.B.String(), connb.LocalAddr().String())
+	as.Equal(s.BytesIn, int64(5))
+	mu.Lock()
+	as.Equal(len(accepts), 2).Equal(len(pairs), 1)
+	mu.Unlock()
+
+	// 被访问控制拒绝的B方连接不调用回调
+	acl := new(ACL)
+	acl.Deny("127.0.0.1")
+	_, baddr = start(acl)
+	conn, err := net.Dial("tcp", baddr)
+	as.NotError(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(p)
+	as.Equal(err, io.EOF)
+	select {
+	case <-closes:
+		t.Fatal("被拒绝的连接调用了 OnClose")
+	case <-time.After(100 * time.Millisecond):
+	}
+	mu.Lock()
+	as.Equal(len(accepts), 2)
+	mu.Unlock()
+}
+
+// 判断L2L的统计
+func Test_L2L_Stats(t *testing.T) {
+	as := assert.New(t, true)
+
+	ll := new(L2L)
+	ll.KeptIdeConn(1)
+	defer ll.Close()
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}
+	bridge, err := ll.Transport(&Addr{Network: "tcp", Local: local}, &Addr{Network: "tcp", Local: local})
+	as.NotError(err)
+	defer bridge.Close()
+	go bridge.Swap()
+
+	conna, err := net.Dial("tcp", ll.alisten.Addr().String())
+	as.NotError(err)
+	defer conna.Close()
+	connb, err := net.Dial("tcp", ll.blisten.Addr().String())
+	as.NotError(err)
+	defer connb.Close()
+
+	conna.Write([]byte("hello"))
+	connb.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, 5)
+	_, err = io.ReadFull(connb, p)
+	as.NotError(err).Equal(string(p), "hello")
+	conna.Close()
+	connb.Close()
+
+	// 等待交换结束
+	var s Stats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if s = bridge.Stats(); s.Completed == 1 {
+			break
+		}
+	}
+	as.Equal(s.Completed, int64(1)).Equal(s.Accepted, int64(2))
+	as.Equal(s.BytesIn, int64(5)).Equal(s.Conns, 0)
+	as.Equal(len(s.Idle), 2)
+}
+
+// 判断负载均衡策略选择远程是否正确
+func Test_Remotes(t *testing.T) {
+	as := assert.New(t, true)
+
+	newRemote := func(port, weight, maxConn int) *Remote {
+		return &Remote{
+			Addr:    &Addr{Network: "tcp", Remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}},
+			Weight:  weight,
+			MaxConn: maxConn,
+		}
+	}
+	caddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	// 轮询
+	r1, r2 := newRemote(1, 0, 0), newRemote(2, 0, 0)
+	rs := NewRemotes(BalanceRoundRobin, r1, r2)
+	for i := 0; i < 4; i++ {
+		r := rs.pick(caddr, nil)
+		as.Equal(r == r1, i%2 == 0)
+		r.release()
+	}
+
+	// 加权轮询
+	r1, r2 = newRemote(1, 1, 0), newRemote(2, 3, 0)
+	rs = NewRemotes(BalanceWeightRoundRobin, r1, r2)
+	count := map[*Remote]int{}
+	for i := 0; i < 8; i++ {
+		r := rs.pick(caddr, nil)
+		count[r]++
+		r.release()
+	}
+	as.Equal(count[r1], 2).Equal(count[r2], 6)
+
+	// 最少连接，连接数上限
+	r1, r2 = newRemote(1, 0, 1), newRemote(2, 0, 1)
+	rs = NewRemotes(BalanceLeastConn, r1, r2)
+	a, b := rs.pick(caddr, nil), rs.pick(caddr, nil)
+	as.NotEqual(a, b).Nil(rs.pick(caddr, nil))
+	a.release()
+	as.Equal(rs.pick(caddr, nil), a)
+
+	// 一致性哈希，同一IP总是选到同一个远程
+	rs = NewRemotes(BalanceHash, newRemote(1, 0, 0), newRemote(2, 0, 0), newRemote(3, 0, 0))
+	first := rs.pick(caddr, nil)
+	for i := 0; i < 10; i++ {
+		r := rs.pick(&net.TCPAddr{IP: caddr.IP, Port: 1000 + i}, nil)
+		as.Equal(r, first)
+	}
+	// 跳过后选择另一个
+	r := rs.pick(caddr, func(r *Remote) bool { return r == first })
+	as.NotNil(r).NotEqual(r, first)
+}
+
+// 判断健康检查标记不可用和恢复是否正确
+func Test_HealthCheck(t *testing.T) {
+	as := assert.New(t, true)
+
+	l := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	up := &Remote{Addr: &Addr{Network: "tcp", Remote: l.Addr()}}
+	defer l.Close()
+
+	dl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	down := &Remote{Addr: &Addr{Network: "tcp", Remote: dl.Addr()}}
+	dl.Close()
+
+	hc := &HealthCheck{MaxFails: 2, Rises: 2}
+	rs := NewRemotes(BalanceRoundRobin, up, down)
+
+	// 被动检测
+	as.False(hc.fail(&down.health)).True(hc.fail(&down.health)).False(down.Healthy())
+	for i := 0; i < 4; i++ {
+		r := rs.pick(nil, nil)
+		as.Equal(r, up)
+		r.release()
+	}
+
+	// 主动探测
+	lg := newLogger(NewJSONLogger(io.Discard, LevelDebug), nil, "")
+	hc.check(&up.health, up.Addr, lg)
+	hc.check(&down.health, down.Addr, lg)
+	as.True(up.Healthy()).False(down.Healthy())
+
+	// 恢复可用需要连续成功
+	as.False(hc.succeed(&down.health)).True(hc.succeed(&down.health)).True(down.Healthy())
+
+	// UDP被拒绝的远程不会恢复可用，有回应的远程恢复可用
+	hc.Timeout = 200 * time.Millisecond
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	uup := &Addr{Network: "udp", Remote: echo.LocalAddr()}
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	as.NotError(err)
+	udown := &Addr{Network: "udp", Remote: dead.LocalAddr()}
+	dead.Close()
+	var hup, hdown health
+	for _, h := range []*health{&hup, &hdown} {
+		hc.fail(h)
+		hc.fail(h)
+		as.False(h.Healthy())
+	}
+	for i := 0; i < 2; i++ {
+		hc.check(&hup, uup, lg)
+		hc.check(&hdown, udown, lg)
+	}
+	as.True(hup.Healthy()).False(hdown.Healthy())
+
+	// 探测耗时超过间隔时不重叠
+	var running, overlap, probes int32
+	slow := &HealthCheck{Interval: 5 * time.Millisecond, Probe: func(ctx context.Context, addr *Addr) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(30 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}}
+	var (
+		closed atomicBool
+		hslow  health
+	)
+	go slow.run(&closed, newLogger(nil, nil, ""), func(f func(*health, *Addr)) { f(&hslow, uup) })
+	time.Sleep(200 * time.Millisecond)
+	closed.setTrue()
+	as.Equal(atomic.LoadInt32(&overlap), int32(0)).True(atomic.LoadInt32(&probes) > 1)
+}
+
+// 判断主远程不通时转到备远程，并报告故障转移
+func Test_L2D_Failover(t *testing.T) {
+	as := assert.New(t, true)
+
+	bl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer bl.Close()
+	pl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	pl.Close()
+
+	primary := &Remote{Addr: &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: pl.Addr()}}
+	backup := &Remote{Addr: &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: bl.Addr()}}
+
+	failover := make(chan [2]*Remote, 1)
+	ld := new(L2D)
+	ld.Timeout = time.Second
+	ld.OnFailover = func(from, to *Remote) {
+		failover <- [2]*Remote{from, to}
+	}
+	defer ld.Close()
+
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridge, err := ld.TransportRemotes(listen, NewRemotes(BalanceFailover, primary, backup))
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer conn.Close()
+
+	b := []byte("failover")
+	conn.Write(b)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, len(b))
+	_, err = io.ReadFull(conn, p)
+	as.NotError(err).Equal(p, b)
+
+	select {
+	case v := <-failover:
+		as.Equal(v[0], primary).Equal(v[1], backup)
+	case <-time.After(time.Second):
+		t.Fatal("没有报告故障转移")
+	}
+}
+
+// 客户端半关闭后，远程读取到EOF，仍然可以回应数据
+func Test_L2D_HalfClose(t *testing.T) {
+	as := assert.New(t, true)
+
+	rl, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NotError(err)
+	defer rl.Close()
+	go func() {
+		conn, err := rl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 读取全部数据后再回应
+		b, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("echo:"), b...))
+	}()
+
+	ld := new(L2D)
+	ld.HalfCloseTimeout = time.Second
+	defer ld.Close()
+
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer conn.Close()
+
+	conn.Write([]byte("half"))
+	as.NotError(conn.(*net.TCPConn).CloseWrite())
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(conn)
+	as.NotError(err).Equal(string(b), "echo:half")
+}
+
+// 判断访问控制规则匹配是否正确
+func Test_ACL(t *testing.T) {
+	as := assert.New(t, true)
+
+	acl, err := ParseACL(bytes.NewBufferString(`
+# 注释
+allow 10.0.0.0/8
+deny  10.1.1.1
+allow 10.1.0.0/16
+allow 2001:db8::/32
+deny  all
+`))
+	as.NotError(err)
+
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 80} }
+	as.True(acl.Permit(addr("10.1.1.1")))
+	as.True(acl.Permit(addr("::ffff:10.2.3.4")))
+	as.True(acl.Permit(&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}))
+	as.False(acl.Permit(addr("192.168.1.1")))
+	as.False(acl.Permit(addr("2001:db9::1")))
+
+	acl = new(ACL)
+	as.NotError(acl.Deny("10.1.1.1"))
+	as.False(acl.Permit(addr("10.1.1.1"))).True(acl.Permit(addr("10.1.1.2")))
+	as.Error(acl.Allow("10.1.1"))
+
+	// nil 全部允许
+	acl = nil
+	as.True(acl.Permit(addr("10.1.1.1")))
+
+	_, err = ParseACL(bytes.NewBufferString("permit 10.0.0.0/8"))
+	as.Error(err)
+}
+
+// 判断单个IP并发连接和新建连接速率限制是否正确
+func Test_ConnLimit(t *testing.T) {
+	as := assert.New(t, true)
+
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+
+	cl := &ConnLimit{PerIPConn: 2}
+	r1, err := cl.acquire(a)
+	as.NotError(err)
+	_, err = cl.acquire(a)
+	as.NotError(err)
+	_, err = cl.acquire(a)
+	as.Equal(err, errLimitIPConn)
+	_, err = cl.acquire(b)
+	as.NotError(err)
+	r1()
+	r1() // 重复释放无效
+	_, err = cl.acquire(a)
+	as.NotError(err)
+	as.Equal(cl.Rejected(), int64(1))
+
+	cl = &ConnLimit{PerIPRate: 1, PerIPBurst: 2, Rate: 100, Burst: 3}
+	for i := 0; i < 2; i++ {
+		_, err = cl.acquire(a)
+		as.NotError(err)
+	}
+	_, err = cl.acquire(a)
+	as.Equal(err, errLimitIPRate)
+	_, err = cl.acquire(b)
+	as.NotError(err)
+	_, err = cl.acquire(&net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1})
+	as.Equal(err, errLimitRate)
+
+	// 全局拒绝时不消耗单个IP的令牌
+	cl = &ConnLimit{PerIPRate: 0.001, PerIPBurst: 1, Rate: 0.001, Burst: 1}
+	_, err = cl.acquire(a)
+	as.NotError(err)
+	_, err = cl.acquire(b)
+	as.Equal(err, errLimitRate)
+	cl.global.refund(1)
+	_, err = cl.acquire(b)
+	as.NotError(err)
+
+	// nil 不限制
+	cl = nil
+	_, err = cl.acquire(a)
+	as.NotError(err)
+}
+
+// 判断生成PROXY协议头是否正确
+func Test_proxyHeader(t *testing.T) {
+	as := assert.New(t, true)
+
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	b, err := proxyHeader(ProxyProtocolV1, src, dst)
+	as.NotError(err).Equal(string(b), "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+
+	b, err = proxyHeader(ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("::2"), Port: 2})
+	as.NotError(err).Equal(string(b), "PROXY TCP6 ::1 ::2 1 2\r\n")
+
+	b, err = proxyHeader(ProxyProtocolV1, &net.UnixAddr{Name: "a"}, dst)
+	as.NotError(err).Equal(string(b), "PROXY UNKNOWN\r\n")
+
+	_, err = proxyHeader(ProxyProtocolV1, &net.UDPAddr{IP: src.IP, Port: 1}, dst)
+	as.Error(err)
+
+	b, err = proxyHeader(ProxyProtocolV2, src, dst)
+	as.NotError(err)
+	as.Equal(b[:12], proxyV2Sig).Equal(b[12:16], []byte{0x21, 0x11, 0x00, 12})
+	as.Equal(b[16:], []byte{192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb})
+
+	b, err = proxyHeader(ProxyProtocolV2, &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1}, &net.UDPAddr{IP: net.ParseIP("::2"), Port: 2})
+	as.NotError(err).Equal(b[12:16], []byte{0x21, 0x22, 0x00, 36}).Equal(len(b), 16+36)
+
+	b, err = proxyHeader(ProxyProtocolV2, nil, nil)
+	as.NotError(err).Equal(b[12:], []byte{0x20, 0x00, 0x00, 0x00})
+}
+
+// 判断读取PROXY协议头后地址和数据是否正确
+func Test_ProxyAccept(t *testing.T) {
+	as := assert.New(t, true)
+
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	accept := func(pa *ProxyAccept, data []byte) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			c2.Write(data)
+		}()
+		return pa.accept(&pipeAddrConn{Conn: c1})
+	}
+
+	local := new(ACL)
+	local.Allow("127.0.0.1")
+	for _, version := range []int{ProxyProtocolV1, ProxyProtocolV2} {
+		head, err := proxyHeader(version, src, dst)
+		as.NotError(err)
+		conn, err := accept(&ProxyAccept{Trusted: local}, append(head, "hello"...))
+		as.NotError(err)
+		as.Equal(conn.RemoteAddr().String(), src.String()).Equal(conn.LocalAddr().String(), dst.String())
+		p := make([]byte, 5)
+		_, err = io.ReadFull(conn, p)
+		as.NotError(err).Equal(string(p), "hello")
+	}
+
+	// 没有设置信任来源，不解析协议头
+	head, err := proxyHeader(ProxyProtocolV1, src, dst)
+	as.NotError(err)
+	conn, err := accept(new(ProxyAccept), head)
+	as.NotError(err).Equal(conn.RemoteAddr().String(), "127.0.0.1:1")
+	_, err = accept(&ProxyAccept{Strict: true}, head)
+	as.Error(err)
+
+	// 没有协议头，原样转发
+	conn, err = accept(&ProxyAccept{Trusted: local}, []byte("hello"))
+	as.NotError(err).Equal(conn.RemoteAddr().String(), "127.0.0.1:1")
+	p := make([]byte, 5)
+	_, err = io.ReadFull(conn, p)
+	as.NotError(err).Equal(string(p), "hello")
+
+	// 严格模式
+	_, err = accept(&ProxyAccept{Strict: true, Trusted: local}, []byte("hello"))
+	as.Error(err)
+	_, err = accept(&ProxyAccept{Strict: true, Trusted: local, Timeout: 10 * time.Millisecond}, nil)
+	as.Error(err)
+	trusted := new(ACL)
+	trusted.Allow("10.0.0.0/8")
+	_, err = accept(&ProxyAccept{Strict: true, Trusted: trusted}, []byte("PROXY UNKNOWN\r\n"))
+	as.Error(err)
+
+	_, err = accept(&ProxyAccept{Trusted: local}, []byte("PROXY TCP4 1.1.1.1\r\n"))
+	as.Error(err)
+}
+
+// net.Pipe 的地址不是IP地址
+type pipeAddrConn struct {
+	net.Conn
+}
+
+func (T *pipeAddrConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+}
+
+// 判断D2D配对后向B方发送PROXY协议头，携带A方的地址
+func Test_D2D_ProxyProtocol(t *testing.T) {
+	as := assert.New(t, true)
+
+	// A方连接后发送数据
+	la, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NotError(err)
+	defer la.Close()
+	go func() {
+		for {
+			conn, err := la.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+		}
+	}()
+
+	// B方读取协议头，池中没有配对的连接不会收到协议头
+	lb, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NotError(err)
+	defer lb.Close()
+	local := new(ACL)
+	local.Allow("127.0.0.1")
+	pa := &ProxyAccept{Trusted: local, Strict: true, Timeout: 5 * time.Second}
+	type result struct {
+		remote string
+		data   string
+	}
+	results := make(chan result, 1)
+	go func() {
+		for {
+			conn, err := lb.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go func() {
+				pconn, err := pa.accept(conn)
+				if err != nil {
+					return
+				}
+				p := make([]byte, 5)
+				if _, err := io.ReadFull(pconn, p); err == nil {
+					results <- result{pconn.RemoteAddr().String(), string(p)}
+				}
+			}()
+		}
+	}()
+
+	dd := &D2D{TryConnTime: 10 * time.Millisecond, ProxyProtocol: ProxyProtocolV2}
+	dd.KeptIdeConn(1)
+	defer dd.Close()
+	bridge, err := dd.Transport(&Addr{Network: "tcp", Remote: la.Addr()}, &Addr{Network: "tcp", Remote: lb.Addr()})
+	as.NotError(err)
+	defer bridge.Close()
+	go bridge.Swap()
+
+	select {
+	case r := <-results:
+		as.Equal(r.remote, la.Addr().String()).Equal(r.data, "hello")
+	case <-time.After(3 * time.Second):
+		t.Fatal("B方没有收到PROXY协议头")
+	}
+	// 发起的连接不计入接受的连接
+	s := bridge.Stats()
+	as.True(s.Dials >= 2).Equal(s.Accepted, int64(0))
+
+	// B方不是TCP，A方是UDP时不支持v1
+	_, err = (&D2D{ProxyProtocol: ProxyProtocolV2}).Transport(&Addr{Network: "tcp", Remote: la.Addr()}, &Addr{Network: "udp", Remote: la.Addr()})
+	as.Error(err)
+	_, err = (&D2D{ProxyProtocol: ProxyProtocolV1}).Transport(&Addr{Network: "udp", Remote: la.Addr()}, &Addr{Network: "tcp", Remote: lb.Addr()})
+	as.Error(err)
+}
+
+// 生成证书，parent 为nil时生成自签名CA证书
+func testCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fatal(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	fatal(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signCert, signKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signCert, signKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signCert, &key.PublicKey, signKey)
+	fatal(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	fatal(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// 后台开始交换，等待交换开启后返回
+func goSwap(bridge *L2DSwap) {
+	go bridge.Swap()
+	for bridge.used.isFalse() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 证书写入文件
+func writeCertFile(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	keyDer, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	fatal(t, err)
+	fatal(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	fatal(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+}
+
+// 判断TLS解密后转发，证书文件修改后重新加载
+func Test_L2D_TLS(t *testing.T) {
+	as := assert.New(t, true)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertFile(t, testCert(t, "one", nil), certFile, keyFile)
+	cf, err := LoadCertFile(certFile, keyFile)
+	as.NotError(err)
+
+	rl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer rl.Close()
+
+	ld := new(L2D)
+	ld.TLSConfig = cf.TLSConfig()
+	defer ld.Close()
+
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	request := func() string {
+		conn, err := tls.Dial(addr.Network(), addr.String(), &tls.Config{InsecureSkipVerify: true})
+		as.NotError(err)
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		p := make([]byte, 5)
+		_, err = io.ReadFull(conn, p)
+		as.NotError(err).Equal(string(p), "hello")
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	as.Equal(request(), "one")
+
+	// 修改证书文件
+	writeCertFile(t, testCert(t, "two", nil), certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	cf.mu.Lock()
+	cf.checked = time.Time{}
+	cf.mu.Unlock()
+	as.Equal(request(), "two")
+}
+
+// 判断向远程发起TLS连接，校验CA，客户端证书和公钥锁定
+func Test_L2D_RemoteTLS(t *testing.T) {
+	as := assert.New(t, true)
+
+	dir := t.TempDir()
+	ca := testCert(t, "ca", nil)
+	server := testCert(t, "server", &ca)
+	client := testCert(t, "client", &ca)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCertFile(t, ca, caFile, filepath.Join(dir, "ca.key"))
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writeCertFile(t, client, certFile, keyFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	rl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	as.NotError(err)
+	defer rl.Close()
+	go func() {
+		for {
+			conn, err := rl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	request := func(config *tls.Config) bool {
+		ld := new(L2D)
+		ld.RemoteTLS = config
+		defer ld.Close()
+
+		listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+		dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+		bridge, err := ld.Transport(listen, dial)
+		as.NotError(err)
+		defer bridge.Close()
+		goSwap(bridge)
+
+		addr := ld.listen.(net.Listener).Addr()
+		conn, err := net.Dial(addr.Network(), addr.String())
+		as.NotError(err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello"))
+		p := make([]byte, 5)
+		_, err = io.ReadFull(conn, p)
+		return err == nil && string(p) == "hello"
+	}
+
+	config, err := NewTLSClientConfig("server", caFile, certFile, keyFile)
+	as.NotError(err)
+	as.True(request(config))
+
+	// 没有客户端证书
+	config, err = NewTLSClientConfig("server", caFile, "", "")
+	as.NotError(err)
+	as.False(request(config))
+
+	// 主机名不匹配
+	config, err = NewTLSClientConfig("other", caFile, certFile, keyFile)
+	as.NotError(err)
+	as.False(request(config))
+
+	// 只锁定公钥，不校验证书链
+	config, err = NewTLSClientConfig("", "", certFile, keyFile, "sha256/"+SPKIHash(server.Leaf))
+	as.NotError(err)
+	as.True(request(config))
+
+	config, err = NewTLSClientConfig("", "", certFile, keyFile, SPKIHash(client.Leaf))
+	as.NotError(err)
+	as.False(request(config))
+}
+
+// 判断双向TLS，客户端证书身份映射
+func Test_L2D_MutualTLS(t *testing.T) {
+	as := assert.New(t, true)
+
+	dir := t.TempDir()
+	ca := testCert(t, "ca", nil)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	writeCertFile(t, testCert(t, "server", &ca), certFile, keyFile)
+	cf, err := LoadCertFile(certFile, keyFile)
+	as.NotError(err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	im, err := ParseIdentityMap(strings.NewReader("# 客户端\nclient1 alice\n"))
+	as.NotError(err)
+
+	rl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer rl.Close()
+
+	ld := new(L2D)
+	ld.TLSConfig = cf.MutualTLSConfig(pool)
+	ld.Identity = im
+	defer ld.Close()
+	ids := make(chan string, 1)
+	ld.Verify(func(conn net.Conn) bool {
+		ids <- ConnIdentity(conn)
+		return true
+	}, nil)
+
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	request := func(certs ...tls.Certificate) bool {
+		conn, err := tls.Dial(addr.Network(), addr.String(), &tls.Config{RootCAs: pool, ServerName: "server", Certificates: certs})
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello"))
+		p := make([]byte, 5)
+		_, err = io.ReadFull(conn, p)
+		return err == nil && string(p) == "hello"
+	}
+
+	as.True(request(testCert(t, "client1", &ca)))
+	as.Equal(<-ids, "alice")
+
+	// 没有客户端证书，没有对应身份，其它CA签发
+	as.False(request())
+	as.False(request(testCert(t, "client2", &ca)))
+	other := testCert(t, "other", nil)
+	as.False(request(testCert(t, "client1", &other)))
+	select {
+	case id := <-ids:
+		t.Fatalf("不应该通过验证: %s", id)
+	default:
+	}
+}
+
+// TLS回显服务器
+func runServerTLS(t *testing.T, config *tls.Config) net.Listener {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	fatal(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// 判断按SNI和ALPN选择远程，读取的ClientHello原样转发
+func Test_L2D_SNIRouter(t *testing.T) {
+	as := assert.New(t, true)
+
+	remotes := func(l net.Listener) *Remotes {
+		return NewRemotes(BalanceRoundRobin, &Remote{Addr: &Addr{Network: "tcp", Remote: l.Addr()}})
+	}
+	backend := func(cn string) net.Listener {
+		return runServerTLS(t, &tls.Config{Certificates: []tls.Certificate{testCert(t, cn, nil)}, NextProtos: []string{"h2", "http/1.1"}})
+	}
+	exact, wildcard, h2 := backend("exact"), backend("wildcard"), backend("h2")
+	defer exact.Close()
+	defer wildcard.Close()
+	defer h2.Close()
+	plain := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer plain.Close()
+
+	router := new(SNIRouter)
+	router.Add("a.example.com", remotes(exact))
+	router.Add("*.example.com", remotes(wildcard))
+	router.Add("*.example.com", remotes(h2), "h2")
+
+	ld := new(L2D)
+	ld.Router = router
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridge, err := ld.TransportRemotes(listen, remotes(plain))
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	request := func(sni string, alpn ...string) string {
+		conn, err := tls.Dial(addr.Network(), addr.String(), &tls.Config{ServerName: sni, NextProtos: alpn, InsecureSkipVerify: true})
+		as.NotError(err)
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		p := make([]byte, 5)
+		_, err = io.ReadFull(conn, p)
+		as.NotError(err).Equal(string(p), "hello")
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	as.Equal(request("a.example.com"), "exact")
+	as.Equal(request("A.Example.com", "h2"), "exact")
+	as.Equal(request("b.c.example.com", "http/1.1"), "wildcard")
+	as.Equal(request("b.example.com", "http/1.1", "h2"), "h2")
+
+	// 没有匹配的路由和不是TLS的连接使用默认远程
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	p := make([]byte, 5)
+	_, err = io.ReadFull(conn, p)
+	as.NotError(err).Equal(string(p), "hello")
+
+	_, _, err = parseClientHello([]byte{0x01, 0x00, 0x00})
+	as.Error(err)
+}
+
+// 判断按Host选择远程，每个请求加入 X-Forwarded-For，不是HTTP的数据原样转发
+func Test_L2D_HTTPRouter(t *testing.T) {
+	as := assert.New(t, true)
+
+	backend := func(name string) (*httptest.Server, *Remotes) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s|%s|%s|%s", name, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), body)
+		}))
+		return s, NewRemotes(BalanceRoundRobin, &Remote{Addr: &Addr{Network: "tcp", Remote: s.Listener.Addr()}})
+	}
+	sa, ra := backend("a")
+	defer sa.Close()
+	sb, rb := backend("b")
+	defer sb.Close()
+	plain := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer plain.Close()
+
+	router := &HTTPRouter{XForwardedFor: ForwardedAppend, XForwardedProto: "https"}
+	router.Add("a.example.com", ra)
+	router.Add("*.b.example.com", rb)
+
+	ld := new(L2D)
+	ld.Router = router
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridge, err := ld.TransportRemotes(listen, NewRemotes(BalanceRoundRobin, &Remote{Addr: &Addr{Network: "tcp", Remote: plain.Addr()}}))
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+	addr := ld.listen.(net.Listener).Addr()
+
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	defer client.CloseIdleConnections()
+	request := func(host string, body io.Reader, header ...string) string {
+		method := "GET"
+		if body != nil {
+			method = "POST"
+		}
+		req, err := http.NewRequest(method, "http://"+addr.String()+"/", body)
+		as.NotError(err)
+		req.Host = host
+		if len(header) != 0 {
+			req.Header.Set("X-Forwarded-For", header[0])
+			req.Header.Set("X-Forwarded-Proto", "http")
+		}
+		resp, err := client.Do(req)
+		as.NotError(err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		as.NotError(err)
+		return string(b)
+	}
+	as.Equal(request("a.example.com:80", nil), "a|127.0.0.1|https|")
+	// 同一个连接的后续请求
+	as.Equal(request("a.example.com:80", strings.NewReader("body"), "10.0.0.1"), "a|10.0.0.1, 127.0.0.1|https|body")
+	as.Equal(request("a.example.com:80", io.MultiReader(strings.NewReader("chunked"))), "a|127.0.0.1|https|chunked")
+	client.CloseIdleConnections()
+	as.Equal(request("c.b.example.com", nil), "b|127.0.0.1|https|")
+
+	router.XForwardedFor = ForwardedReplace
+	client.CloseIdleConnections()
+	as.Equal(request("c.b.example.com", nil, "10.0.0.1"), "b|127.0.0.1|https|")
+
+	// 不是HTTP的数据原样转发
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer conn.Close()
+	conn.Write([]byte("\x00hello"))
+	p := make([]byte, 6)
+	_, err = io.ReadFull(conn, p)
+	as.NotError(err).Equal(string(p), "\x00hello")
+}
+
+// 判断需要修改请求头时，第一个请求不是HTTP的数据原样转发，之后格式错误的请求关闭连接，远程响应101之后才原样转发
+func Test_L2D_HTTPRouterRewrite(t *testing.T) {
+	as := assert.New(t, true)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/echo" {
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			brw.Flush()
+			io.Copy(conn, brw.Reader)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer s.Close()
+
+	ld := new(L2D)
+	ld.Router = &HTTPRouter{XForwardedFor: ForwardedReplace}
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridge, err := ld.TransportRemotes(listen, NewRemotes(BalanceRoundRobin, &Remote{Addr: &Addr{Network: "tcp", Remote: s.Listener.Addr()}}))
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+	addr := ld.listen.(net.Listener).Addr()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		as.NotError(err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	// 发送请求，返回响应的状态码和内容，连接被关闭时返回错误
+	request := func(conn net.Conn, br *bufio.Reader, req string) (int, string, error) {
+		if _, err := conn.Write([]byte(req)); err != nil {
+			return 0, "", err
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp.StatusCode, "", nil
+		}
+		b, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), err
+	}
+	spoof := "GET / HTTP/1.1\r\nHost: a\r\nX-Forwarded-For: 10.0.0.1\r\n\r\n"
+
+	// 请求头带有 Connection: upgrade，但远程没有升级协议，之后的请求仍然修改
+	conn, br := dial()
+	defer conn.Close()
+	code, body, err := request(conn, br, "GET / HTTP/1.1\r\nHost: a\r\nConnection: upgrade\r\nUpgrade: echo\r\n\r\n")
+	as.NotError(err).Equal(code, 200).Equal(body, "127.0.0.1")
+	_, body, err = request(conn, br, spoof)
+	as.NotError(err).Equal(body, "127.0.0.1")
+
+	// 过长的请求头关闭连接，不转为原样转发
+	_, _, err = request(conn, br, "GET / HTTP/1.1\r\nHost: a\r\nX-Long: "+strings.Repeat("a", httpMaxHeader)+"\r\n\r\n"+spoof)
+	as.Error(err)
+
+	// 远程响应101之后原样转发
+	conn, br = dial()
+	defer conn.Close()
+	code, _, err = request(conn, br, "GET /echo HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	as.NotError(err).Equal(code, 101)
+	conn.Write([]byte(spoof))
+	p := make([]byte, len(spoof))
+	_, err = io.ReadFull(br, p)
+	as.NotError(err).Equal(string(p), spoof)
+
+	// 修改过请求头之后，不是HTTP的数据，重复的 Content-Length 关闭连接
+	for _, req := range []string{
+		"\x00hello",
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 5\r\n\r\nhello",
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	} {
+		conn, br := dial()
+		_, body, err = request(conn, br, spoof)
+		as.NotError(err).Equal(body, "127.0.0.1")
+		_, _, err = request(conn, br, req)
+		as.Error(err)
+		conn.Close()
+	}
+}
+
+// 判断远程的响应分多次写入，前面有之前请求的响应时，按升级协议请求的响应转为原样转发
+func Test_httpConn(t *testing.T) {
+	as := assert.New(t, true)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	go b.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /ws HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n\x00raw"))
+
+	conn, _, err := (&HTTPRouter{XForwardedProto: "http"}).Route(a)
+	as.NotError(err)
+	hc := conn.(*httpConn)
+	var got []byte
+	p := make([]byte, 256)
+	for bytes.Count(got, []byte("\r\n\r\n")) < 2 {
+		n, err := hc.Read(p)
+		as.NotError(err)
+		got = append(got, p[:n]...)
+	}
+	pending := func() bool {
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+		return hc.resp.pending != nil
+	}
+
+	// 第一个请求的响应，块数据像是升级协议的响应
+	hc.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n10\r\nHTTP/1.1 1"))
+	hc.Write([]byte("01 X\r\n\r\n0\r\n\r\n"))
+	as.True(pending())
+	// 状态行分两次写入
+	hc.Write([]byte("HTTP/1.1 10"))
+	as.True(pending())
+	hc.Write([]byte("1 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	as.False(pending())
+
+	n, err := hc.Read(p)
+	as.NotError(err).Equal(string(p[:n]), "\x00raw")
+}
+
+// 先发送标记再回显的服务器
+func runServerTag(t *testing.T, tag string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(tag + "|"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// 判断按最先发送的数据识别协议选择远程
+func Test_L2D_MuxRouter(t *testing.T) {
+	as := assert.New(t, true)
+
+	remotes := func(tag string) *Remotes {
+		l := runServerTag(t, tag)
+		t.Cleanup(func() { l.Close() })
+		return NewRemotes(BalanceRoundRobin, &Remote{Addr: &Addr{Network: "tcp", Remote: l.Addr()}})
+	}
+	router := &MuxRouter{Timeout: 200 * time.Millisecond, OnTimeout: remotes("wait")}
+	for _, p := range []string{"ssh", "tls", "http", "socks5", "openvpn"} {
+		as.NotError(router.Add(p, remotes(p)))
+	}
+	as.Error(router.Add("ftp", nil))
+	router.AddPrefix([]byte("HELO"), remotes("helo"))
+	router.AddRegexp(regexp.MustCompile(`^\d+ `), remotes("num"))
+
+	ld := new(L2D)
+	ld.Router = router
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridge, err := ld.TransportRemotes(listen, remotes("default"))
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+	addr := ld.listen.(net.Listener).Addr()
+
+	request := func(data ...[]byte) string {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		as.NotError(err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		var all []byte
+		for _, b := range data {
+			// 分开发送，需要读取更多数据
+			conn.Write(b)
+			time.Sleep(20 * time.Millisecond)
+			all = append(all, b...)
+		}
+		r := bufio.NewReader(conn)
+		tag, err := r.ReadString('|')
+		as.NotError(err)
+		p := make([]byte, len(all))
+		_, err = io.ReadFull(r, p)
+		as.NotError(err).Equal(string(p), string(all))
+		return strings.TrimSuffix(tag, "|")
+	}
+	as.Equal(request([]byte("SS"), []byte("H-2.0-OpenSSH\r\n")), "ssh")
+	as.Equal(request([]byte{0x16, 0x03, 0x01, 0x00, 0x05}), "tls")
+	as.Equal(request([]byte("GE"), []byte("T / HTTP/1.1\r\n")), "http")
+	as.Equal(request([]byte{0x05, 0x02, 0x00}, []byte{0x02}), "socks5")
+	as.Equal(request([]byte{0x00, 0x0e, 0x38, 0x01}), "openvpn")
+	as.Equal(request([]byte("HELO x")), "helo")
+	as.Equal(request([]byte("220 ok")), "num")
+	as.Equal(request([]byte("xyz")), "default")
+	as.Equal(request(), "wait")
+}
+
+// UDP回显服务器
+func listenEchoUDP(tb testing.TB) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		p := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(p)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(p[:n], addr)
+		}
+	}()
+	return pc
+}
+
+// UDP转发，返回客户端连接
+func dialL2DUDP(tb testing.TB, ld *L2D, remote net.Addr) (*L2DSwap, net.Conn) {
+	listen := &Addr{Network: "udp", Local: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "udp", Remote: remote}
+	bridge, err := ld.Transport(listen, dial)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go bridge.Swap()
+	for bridge.used.isFalse() {
+		time.Sleep(time.Millisecond)
+	}
+	addr := ld.listen.(net.PacketConn).LocalAddr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return bridge, conn
+}
+
+// 判断同一个会话的数据报按顺序转发
+func Test_L2D_UDPOrder(t *testing.T) {
+	as := assert.New(t, true)
+
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	ld := &L2D{UDPWorkers: 4}
+	defer ld.Close()
+	bridge, conn := dialL2DUDP(t, ld, echo.LocalAddr())
+	defer bridge.Close()
+	defer conn.Close()
+
+	const count = 200
+	for i := 0; i < count; i++ {
+		conn.Write([]byte(strconv.Itoa(i)))
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p := make([]byte, 64)
+	last := -1
+	for i := 0; i < count; i++ {
+		n, err := conn.Read(p)
+		if err != nil {
+			// 回环网络也可能丢包，只判断顺序
+			break
+		}
+		v, err := strconv.Atoi(string(p[:n]))
+		as.NotError(err).True(v > last, v, last)
+		last = v
+	}
+	as.True(last >= 0)
+	as.Equal(bridge.ConnNum(), 1)
+}
+
+// 判断UDP会话表的淘汰，统计和过期
+func Test_L2D_UDPSessions(t *testing.T) {
+	as := assert.New(t, true)
+
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	ld := &L2D{UDPMaxSessions: 2, UDPIdleTimeout: 300 * time.Millisecond}
+	defer ld.Close()
+	bridge, conn1 := dialL2DUDP(t, ld, echo.LocalAddr())
+	defer bridge.Close()
+	defer conn1.Close()
+
+	addr := ld.listen.(net.PacketConn).LocalAddr()
+	conns := []net.Conn{conn1}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		as.NotError(err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	p := make([]byte, 64)
+	for _, conn := range conns {
+		// 同一个客户端多个数据报只建立一个会话
+		for i := 0; i < 3; i++ {
+			conn.Write([]byte("ping"))
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := conn.Read(p)
+			as.NotError(err).Equal(string(p[:n]), "ping")
+		}
+	}
+
+	// 超过最大数量，第一个客户端的会话被淘汰
+	ss := bridge.Sessions()
+	as.Equal(len(ss), 2)
+	as.Equal(ss[0].Client.String(), conns[2].LocalAddr().String())
+	as.Equal(ss[1].Client.String(), conns[1].LocalAddr().String())
+	as.Equal(ss[0].SentPackets, int64(3)).Equal(ss[0].SentBytes, int64(12))
+	as.Equal(ss[0].RecvPackets, int64(3)).Equal(ss[0].RecvBytes, int64(12))
+	as.Equal(ss[0].Remote.String(), echo.LocalAddr().String())
+
+	as.True(bridge.ExpireSession(conns[1].LocalAddr()))
+	as.False(bridge.ExpireSession(conns[1].LocalAddr()))
+	as.Equal(len(bridge.Sessions()), 1)
+	as.Equal(bridge.ExpireIdle(time.Hour), 0)
+
+	// 空闲超时
+	time.Sleep(600 * time.Millisecond)
+	as.Equal(len(bridge.Sessions()), 0)
+	as.Equal(bridge.ConnNum(), 0)
+}
+
+// 从其它套接字回应的UDP服务，返回接收地址
+func listenReplyFromUDP(tb testing.TB, from string) (net.PacketConn, net.PacketConn) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	reply, err := net.ListenPacket("udp", from)
+	if err != nil {
+		pc.Close()
+		tb.Skip(err)
+	}
+	go func() {
+		p := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(p)
+			if err != nil {
+				return
+			}
+			reply.WriteTo(p[:n], addr)
+		}
+	}()
+	return pc, reply
+}
+
+// 判断未连接的UDP按来源过滤回应
+func Test_L2D_UDPReply(t *testing.T) {
+	as := assert.New(t, true)
+
+	tests := []struct {
+		reply int
+		from  string
+		ok    bool
+	}{
+		{UDPReplyConnected, "127.0.0.1:0", false},
+		{UDPReplySameIP, "127.0.0.1:0", true},
+		{UDPReplySameIP, "127.0.0.2:0", false},
+		{UDPReplyAny, "127.0.0.2:0", true},
+	}
+	for _, test := range tests {
+		func() {
+			pc, reply := listenReplyFromUDP(t, test.from)
+			defer pc.Close()
+			defer reply.Close()
+
+			ld := &L2D{UDPReply: test.reply}
+			defer ld.Close()
+			bridge, conn := dialL2DUDP(t, ld, pc.LocalAddr())
+			defer bridge.Close()
+			defer conn.Close()
+
+			p := make([]byte, 64)
+			var err error
+			for i := 0; i < 3; i++ {
+				conn.Write([]byte("ping"))
+				conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				var n int
+				if n, err = conn.Read(p); err == nil {
+					as.Equal(string(p[:n]), "ping")
+					break
+				}
+			}
+			as.Equal(err == nil, test.ok, test.reply, test.from)
+		}()
+	}
+}
+
+// 判断帧读取超时后可以继续读取，数据流按帧拆分为数据报
+func Test_frameConn(t *testing.T) {
+	as := assert.New(t, true)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	fc := newFrameConn(a)
+
+	go b.Write([]byte{0, 5, 'h', 'e'})
+	p := make([]byte, 64)
+	fc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := fc.Read(p)
+	as.Error(err)
+	go b.Write([]byte{'l', 'l', 'o', 0, 0})
+	fc.SetReadDeadline(time.Time{})
+	n, err := fc.Read(p)
+	as.NotError(err).Equal(string(p[:n]), "hello")
+	n, err = fc.Read(p)
+	as.NotError(err).Equal(n, 0)
+
+	_, err = fc.Write(make([]byte, frameMaxSize+1))
+	as.Error(err)
+
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	uconn, err := net.Dial("udp", echo.LocalAddr().String())
+	as.NotError(err)
+	uc := newUnframeConn(uconn, nil, 0)
+	defer uc.Close()
+
+	// 帧跨越多次写入
+	stream := []byte{0, 1, 'a', 0, 2, 'b', 'b', 0, 3, 'c', 'c', 'c'}
+	for _, chunk := range [][]byte{stream[:1], stream[1:4], stream[4:10], stream[10:]} {
+		n, err = uc.Write(chunk)
+		as.NotError(err).Equal(n, len(chunk))
+	}
+	uc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got []byte
+	for len(got) < len(stream) {
+		n, err = uc.Read(p[:4])
+		as.NotError(err)
+		got = append(got, p[:n]...)
+	}
+	as.Equal(got, stream)
+}
+
+// UDP → L2D → TCP → L2D → UDP，数据报边界不变
+func Test_L2D_UDPOverTCP(t *testing.T) {
+	as := assert.New(t, true)
+
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+
+	// TCP拆分为数据报
+	ldt := &L2D{UDPOverTCP: true}
+	defer ldt.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridget, err := ldt.Transport(listen, &Addr{Network: "udp", Remote: echo.LocalAddr()})
+	as.NotError(err)
+	defer bridget.Close()
+	goSwap(bridget)
+
+	// UDP会话按帧通过TCP转发
+	ldu := &L2D{UDPOverTCP: true}
+	defer ldu.Close()
+	listen = &Addr{Network: "udp", Local: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridgeu, err := ldu.Transport(listen, &Addr{Network: "tcp", Remote: ldt.listen.(net.Listener).Addr()})
+	as.NotError(err)
+	defer bridgeu.Close()
+	goSwap(bridgeu)
+
+	addr := ldu.listen.(net.PacketConn).LocalAddr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer conn.Close()
+
+	p := make([]byte, 2048)
+	for _, msg := range []string{"a", "bb", strings.Repeat("c", 1400)} {
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(p)
+		as.NotError(err).Equal(string(p[:n]), msg)
+	}
+	as.Equal(len(bridgeu.Sessions()), 1)
+	as.Equal(bridget.ConnNum(), 1)
+
+	// 拆分为数据报的连接双方空闲超时后结束
+	ldi := &L2D{UDPOverTCP: true, UDPIdleTimeout: 200 * time.Millisecond}
+	defer ldi.Close()
+	listen = &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	bridgei, err := ldi.Transport(listen, &Addr{Network: "udp", Remote: echo.LocalAddr()})
+	as.NotError(err)
+	defer bridgei.Close()
+	goSwap(bridgei)
+	tconn, err := net.Dial("tcp", ldi.listen.(net.Listener).Addr().String())
+	as.NotError(err)
+	defer tconn.Close()
+	fc := newFrameConn(tconn)
+	fc.Write([]byte("ping"))
+	fc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := fc.Read(p)
+	as.NotError(err).Equal(string(p[:n]), "ping")
+	start := time.Now()
+	_, err = fc.Read(p)
+	as.Equal(err, io.EOF).True(time.Since(start) < time.Second)
+}
+
+// 判断UDP会话通过TCP发起连接时不阻塞其它客户端，没有设置 Timeout 也会超时，期间的数据报暂存
+func Test_L2D_UDPOverTCPDial(t *testing.T) {
+	as := assert.New(t, true)
+
+	echo := runServerTLS(t, &tls.Config{Certificates: []tls.Certificate{testCert(t, "server", nil)}})
+	defer echo.Close()
+	// 接受连接但不回应TLS握手
+	stall, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NotError(err)
+	defer stall.Close()
+	go func() {
+		for {
+			conn, err := stall.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ld := &L2D{UDPOverTCP: true, UDPIdleTimeout: 500 * time.Millisecond, RemoteTLS: &tls.Config{InsecureSkipVerify: true}}
+	defer ld.Close()
+	listen := &Addr{Network: "udp", Local: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	rs := NewRemotes(BalanceFailover,
+		&Remote{Addr: &Addr{Network: "tcp", Remote: stall.Addr()}, MaxConn: 1},
+		&Remote{Addr: &Addr{Network: "tcp", Remote: echo.Addr()}},
+	)
+	bridge, err := ld.TransportRemotes(listen, rs)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+	addr := ld.listen.(net.PacketConn).LocalAddr()
+
+	// 第一个客户端向没有回应的远程发起连接
+	stalled, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer stalled.Close()
+	stalled.Write([]byte("a"))
+	time.Sleep(100 * time.Millisecond)
+
+	// 第二个客户端不被阻塞
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer conn.Close()
+	start := time.Now()
+	conn.Write([]byte("b"))
+	p := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(p)
+	as.NotError(err).Equal(string(p[:n]), "b")
+	as.True(time.Since(start) < 300*time.Millisecond)
+
+	// 第一个客户端超时后转到下一个远程，暂存的数据报继续转发
+	stalled.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err = stalled.Read(p)
+	as.NotError(err).Equal(string(p[:n]), "a")
+}
+
+// 判断第一个数据报发起连接的同时关闭会话，远程的连接数只释放一次
+func Test_L2D_UDPSessionCloseDial(t *testing.T) {
+	as := assert.New(t, true)
+
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	for i := 0; i < 50; i++ {
+		ld := &L2D{}
+		listen := &Addr{Network: "udp", Local: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+		remote := &Remote{Addr: &Addr{Network: "udp", Remote: echo.LocalAddr()}}
+		bridge, err := ld.TransportRemotes(listen, NewRemotes(BalanceRoundRobin, remote))
+		as.NotError(err)
+		goSwap(bridge)
+		addr := ld.listen.(net.PacketConn).LocalAddr()
+
+		conn, err := net.Dial(addr.Network(), addr.String())
+		as.NotError(err)
+		conn.Write([]byte("a"))
+		// 会话建立后立即关闭，发起连接可能还没有结束
+		for len(bridge.Sessions()) == 0 {
+			time.Sleep(time.Microsecond)
+		}
+		bridge.Close()
+		ld.Close()
+		conn.Close()
+
+		for j := 0; j < 50 && remote.ConnNum() != 0; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		as.Equal(remote.ConnNum(), 0, i)
+	}
+}
+
+// 每个数据报的分配次数
+func Benchmark_L2D_UDP(b *testing.B) {
+	echo := listenEchoUDP(b)
+	defer echo.Close()
+	ld := new(L2D)
+	defer ld.Close()
+	bridge, conn := dialL2DUDP(b, ld, echo.LocalAddr())
+	defer bridge.Close()
+	defer conn.Close()
+
+	data := make([]byte, 512)
+	p := make([]byte, 2048)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 模拟丢包的UDP连接，收发都按丢包率丢弃
+type lossyPacketConn struct {
+	net.PacketConn
+	loss float64
+	r    *mrand.Rand
+	mu   sync.Mutex
+}
+
+func (T *lossyPacketConn) drop() bool {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	return T.r.Float64() < T.loss
+}
+
+func (T *lossyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := T.PacketConn.ReadFrom(p)
+		if err != nil || !T.drop() {
+			return n, addr, err
+		}
+	}
+}
+
+func (T *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if T.drop() {
+		return len(p), nil
+	}
+	return T.PacketConn.WriteTo(p, addr)
+}
+
+// 判断可靠UDP在丢包时数据完整，关闭后对方读取到 io.EOF
+func Test_RUDP(t *testing.T) {
+	as := assert.New(t, true)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	as.NotError(err)
+	config := &RUDPConfig{Interval: 5 * time.Millisecond, KeepAlive: time.Second}
+	l := ServeRUDP(&lossyPacketConn{PacketConn: pc, loss: 0.1, r: mrand.New(mrand.NewSource(1))}, config)
+	defer l.Close()
+
+	eof := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			eof <- err
+			return
+		}
+		_, err = io.Copy(conn, conn)
+		eof <- err
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialRUDP(ctx, "rudp", l.Addr().String(), config)
+	as.NotError(err)
+
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	_, err = io.ReadFull(conn, got)
+	as.NotError(err).True(bytes.Equal(got, data))
+
+	conn.Close()
+	select {
+	case err := <-eof:
+		as.NotError(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("对方没有读取到关闭")
+	}
+	_, err = conn.Read(got)
+	as.Error(err)
+
+	// 没有监听时连接失败
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	as.NotError(err)
+	closed.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = DialRUDP(ctx, "rudp", closed.LocalAddr().String(), config)
+	as.Error(err)
+}
+
+// 判断L2L使用可靠UDP监听
+func Test_L2L_RUDP(t *testing.T) {
+	as := assert.New(t, true)
+
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}
+	ll := new(L2L)
+	defer ll.Close()
+	bridge, err := ll.Transport(&Addr{Network: "rudp", Local: local}, &Addr{Network: "rudp", Local: local})
+	as.NotError(err)
+	defer bridge.Close()
+	go bridge.Swap()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conna, err := DialRUDP(ctx, "rudp", ll.alisten.Addr().String(), nil)
+	as.NotError(err)
+	defer conna.Close()
+	connb, err := DialRUDP(ctx, "rudp", ll.blisten.Addr().String(), nil)
+	as.NotError(err)
+	defer connb.Close()
+
+	conna.Write([]byte("hello"))
+	connb.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p := make([]byte, 10)
+	n, err := connb.Read(p)
+	as.NotError(err).Equal(string(p[:n]), "hello")
+}
+
+// 判断速率解析是否正确
+func Test_ParseRate(t *testing.T) {
+	as := assert.New(t, true)
+
+	up, down, err := ParseRate("1M,512K")
+	as.NotError(err).Equal(up, float64(1<<20)).Equal(down, float64(512<<10))
+	up, down, err = ParseRate("100")
+	as.NotError(err).Equal(up, float64(100)).Equal(down, float64(100))
+	up, down, err = ParseRate("0,2GB")
+	as.NotError(err).Equal(up, float64(0)).Equal(down, float64(2<<30))
+	_, _, err = ParseRate("1M,")
+	as.Error(err)
+	_, _, err = ParseRate("-1")
+	as.Error(err)
+}
+
+// 判断UDP数据报被后一级的限制丢弃时，退回之前各级取出的令牌
+func Test_allowPacket(t *testing.T) {
+	as := assert.New(t, true)
+
+	rl := new(RateLimit)
+	rl.SetPackets(1000, 0)
+	rl.SetIP(200, 0)
+	rl.SetSwap(100, 0)
+	var swap rateScope
+	rate := rl.acquire(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, &swap)
+	defer rate.release()
+
+	tokens := func(b *tokenBucket) float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.tokens
+	}
+	as.True(rate.allowPacket(dirUp, 60))
+	ip, packets := tokens(&rate.ip.scope[dirUp]), tokens(&rate.packets[dirUp])
+	for i := 0; i < 5; i++ {
+		as.False(rate.allowPacket(dirUp, 60))
+	}
+	// 只有经过时间补充的令牌
+	as.True(tokens(&rate.ip.scope[dirUp]) >= ip).True(tokens(&rate.ip.scope[dirUp]) < ip+10)
+	as.True(tokens(&rate.packets[dirUp]) >= packets).True(tokens(&rate.packets[dirUp]) < packets+10)
+}
+
+// 下行带宽限制，运行时修改后生效
+func Test_L2D_RateLimit(t *testing.T) {
+	as := assert.New(t, true)
+
+	const size = 64 << 10
+	rl, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NotError(err)
+	defer rl.Close()
+	go func() {
+		for {
+			conn, err := rl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write(make([]byte, size))
+				conn.Close()
+			}()
+		}
+	}()
+
+	rate := new(RateLimit)
+	rate.SetConn(0, size/2)
+	ld := &L2D{RateLimit: rate}
+	defer ld.Close()
+
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	read := func() time.Duration {
+		start := time.Now()
+		conn, err := net.Dial(addr.Network(), addr.String())
+		as.NotError(err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := io.ReadAll(conn)
+		as.NotError(err).Equal(len(b), size)
+		return time.Since(start)
+	}
+
+	// 桶容量为1秒，剩余一半需要等待约1秒
+	d := read()
+	as.True(d >= 800*time.Millisecond, d)
+
+	rate.SetConn(0, 0)
+	d = read()
+	as.True(d < 500*time.Millisecond, d)
+}
+
+// UDP超过每秒数据报数量时丢弃
+func Test_L2D_UDPRateLimit(t *testing.T) {
+	as := assert.New(t, true)
+
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	rate := new(RateLimit)
+	rate.SetPackets(5, 0)
+	ld := &L2D{RateLimit: rate}
+	defer ld.Close()
+	bridge, conn := dialL2DUDP(t, ld, echo.LocalAddr())
+	defer bridge.Close()
+	defer conn.Close()
+
+	for i := 0; i < 20; i++ {
+		conn.Write([]byte("ping"))
+	}
+	recv := 0
+	p := make([]byte, 64)
+	for {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, err := conn.Read(p); err != nil {
+			break
+		}
+		recv++
+	}
+	as.True(recv >= 5 && recv <= 6, recv)
+}
+
+// 判断交换的统计是否正确
+func Test_L2D_Stats(t *testing.T) {
+	as := assert.New(t, true)
+
+	rl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer rl.Close()
+
+	acl := new(ACL)
+	ld := &L2D{ACL: acl}
+	defer ld.Close()
+
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	b := []byte("stats")
+	conn.Write(b)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, len(b))
+	_, err = io.ReadFull(conn, p)
+	as.NotError(err).Equal(p, b)
+
+	// 写入完成后才计数，等待统计更新
+	waitStats := func(bridge *L2DSwap, f func(s Stats) bool) Stats {
+		for i := 0; i < 100 && !f(bridge.Stats()); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return bridge.Stats()
+	}
+	s := waitStats(bridge, func(s Stats) bool { return s.BytesOut == int64(len(b)) })
+	as.Equal(s.Conns, 1).Equal(s.Accepted, int64(1)).Equal(s.Dials, int64(1))
+	as.Equal(s.BytesIn, int64(len(b))).Equal(s.BytesOut, int64(len(b)))
+	as.True(s.DialLatency > 0 && s.DialLatency <= s.DialLatencyMax)
+	as.Equal(s.DialHistogram[len(s.DialHistogram)-1], int64(1)).Nil(s.Idle)
+	conn.Close()
+
+	// 访问控制拒绝
+	as.NotError(acl.Deny("all"))
+	conn, err = net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(p)
+	as.Error(err)
+	conn.Close()
+
+	s = waitStats(bridge, func(s Stats) bool { return s.Completed == 1 })
+	as.Equal(s.Conns, 0).Equal(s.Accepted, int64(1)).Equal(s.Rejected, int64(1)).Equal(s.Completed, int64(1))
+
+	// UDP数据报
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	uld := new(L2D)
+	defer uld.Close()
+	ubridge, uconn := dialL2DUDP(t, uld, echo.LocalAddr())
+	defer ubridge.Close()
+	defer uconn.Close()
+	uconn.Write([]byte("ping"))
+	uconn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = uconn.Read(p)
+	as.NotError(err)
+	s = waitStats(ubridge, func(s Stats) bool { return s.PacketsOut == 1 })
+	as.Equal(s.Accepted, int64(1)).Equal(s.PacketsIn, int64(1)).Equal(s.BytesIn, int64(4))
+	as.Equal(s.PacketsOut, int64(1)).Equal(s.BytesOut, int64(4))
+}
+
+func Test_Metrics(t *testing.T) {
+	as := assert.New(t, true)
+
+	// 远程拒绝连接
+	rl, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NotError(err)
+	rl.Close()
+
+	ld := new(L2D)
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	as.Error(err)
+	conn.Close()
+	for i := 0; i < 100 && bridge.Stats().Failed == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ts := httptest.NewServer(MetricsHandler(func() map[string]Stats {
+		return map[string]Stats{
+			`web "1"`: bridge.Stats(),
+			"pool":    {Conns: 2, Idle: []int{3, 4}, Dials: 1, DialLatencySum: 20 * time.Millisecond, DialHistogram: [len(DialLatencyBuckets)]int64{0, 0, 0, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		}
+	}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	as.NotError(err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	as.NotError(err).Equal(resp.Header.Get("Content-Type"), MetricsContentType)
+
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE vforward_connections gauge",
+		`vforward_connections{rule="pool"} 2`,
+		`vforward_pool_idle_connections{rule="pool",side="b"} 4`,
+		`vforward_connections_failed_total{rule="web \"1\""} 1`,
+		`vforward_dial_errors_total{rule="web \"1\"",reason="refused"} 1`,
+		`vforward_dial_errors_total{rule="web \"1\"",reason="timeout"} 0`,
+		"# TYPE vforward_dial_latency_seconds histogram",
+		`vforward_dial_latency_seconds_bucket{rule="pool",le="0.01"} 0`,
+		`vforward_dial_latency_seconds_bucket{rule="pool",le="0.025"} 1`,
+		`vforward_dial_latency_seconds_bucket{rule="pool",le="+Inf"} 1`,
+		`vforward_dial_latency_seconds_sum{rule="pool"} 0.02`,
+		`vforward_dial_latency_seconds_count{rule="pool"} 1`,
+	} {
+		as.True(strings.Contains(text, line+"\n"), line)
+	}
+	as.False(strings.Contains(text, `vforward_pool_idle_connections{rule="web`))
+}
+
+func Test_L2D_Hooks(t *testing.T) {
+	as := assert.New(t, true)
+
+	rl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer rl.Close()
+
+	var (
+		mu      sync.Mutex
+		accepts []net.Addr
+		dials   []error
+		closes  []Session
+		closed  = make(chan struct{}, 2)
+	)
+	hooks := &Hooks{
+		OnAccept: func(local, remote net.Addr) {
+			mu.Lock()
+			defer mu.Unlock()
+			accepts = append(accepts, remote)
+		},
+		OnDial: func(network, addr string, latency time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dials = append(dials, err)
+		},
+		OnClose: func(s *Session) {
+			mu.Lock()
+			closes = append(closes, *s)
+			mu.Unlock()
+			closed <- struct{}{}
+		},
+	}
+
+	ld := &L2D{Hooks: hooks}
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	b := []byte("hooks")
+	conn.Write(b)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, len(b))
+	_, err = io.ReadFull(conn, p)
+	as.NotError(err).Equal(p, b)
+	conn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnClose 没有调用")
+	}
+	mu.Lock()
+	as.Equal(len(accepts), 1).Equal(accepts[0].String(), conn.LocalAddr().String())
+	as.Equal(len(dials), 1).NotError(dials[0])
+	as.Equal(len(closes), 1)
+	s := closes[0]
+	as.Equal(s.A.String(), conn.LocalAddr().String()).Equal(s.B.String(), rl.Addr().String())
+	as.Equal(s.BytesIn, int64(len(b))).Equal(s.BytesOut, int64(len(b)))
+	as.True(s.Duration > 0).NotError(s.Err)
+	mu.Unlock()
+
+	// UDP会话空闲超时结束
+	echo := listenEchoUDP(t)
+	defer echo.Close()
+	uld := &L2D{Hooks: hooks, UDPIdleTimeout: 100 * time.Millisecond}
+	defer uld.Close()
+	ubridge, uconn := dialL2DUDP(t, uld, echo.LocalAddr())
+	defer ubridge.Close()
+	defer uconn.Close()
+	uconn.Write([]byte("ping"))
+	uconn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = uconn.Read(p)
+	as.NotError(err)
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("UDP会话 OnClose 没有调用")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	as.Equal(len(accepts), 2).Equal(len(dials), 2).Equal(len(closes), 2)
+	s = closes[1]
+	as.Equal(s.BytesIn, int64(4)).Equal(s.BytesOut, int64(4)).NotError(s.Err)
+}
+
+// 判断发起连接失败也调用 OnClose，被访问控制拒绝的连接不调用 OnAccept 和 OnClose
+func Test_L2D_HooksReject(t *testing.T) {
+	as := assert.New(t, true)
+
+	// 没有监听的端口
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NotError(err)
+	dead := l.Addr()
+	l.Close()
+
+	var accepts int32
+	closes := make(chan Session, 1)
+	// 连接到 L2D，等待连接被关闭
+	request := func(ld *L2D) net.Conn {
+		ld.Hooks = &Hooks{
+			OnAccept: func(local, remote net.Addr) { atomic.AddInt32(&accepts, 1) },
+			OnClose:  func(s *Session) { closes <- *s },
+		}
+		listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+		bridge, err := ld.Transport(listen, &Addr{Network: "tcp", Remote: dead})
+		as.NotError(err)
+		t.Cleanup(func() { bridge.Close(); ld.Close() })
+		goSwap(bridge)
+		addr := ld.listen.(net.Listener).Addr()
+
+		conn, err := net.Dial(addr.Network(), addr.String())
+		as.NotError(err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		as.Equal(err, io.EOF)
+		return conn
+	}
+
+	// 发起连接失败
+	conn := request(new(L2D))
+	select {
+	case s := <-closes:
+		as.Equal(s.A.String(), conn.LocalAddr().String()).Nil(s.B).Error(s.Err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnClose 没有调用")
+	}
+	as.Equal(atomic.LoadInt32(&accepts), int32(1))
+
+	// 访问控制拒绝
+	acl := new(ACL)
+	acl.Deny("127.0.0.1")
+	request(&L2D{ACL: acl})
+	select {
+	case <-closes:
+		t.Fatal("被拒绝的连接调用了 OnClose")
+	case <-time.After(100 * time.Millisecond):
+	}
+	as.Equal(atomic.LoadInt32(&accepts), int32(1))
+}
+
+func Test_Logger(t *testing.T) {
+	as := assert.New(t, true)
+
+	level, err := ParseLogLevel("WARN")
+	as.NotError(err).Equal(level, LevelWarn).Equal(level.String(), "warn")
+	_, err = ParseLogLevel("trace")
+	as.Error(err)
+
+	// 文本
+	var buf bytes.Buffer
+	lg := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+	lg.Log(LevelDebug, "忽略")
+	lg.Log(LevelWarn, "拒绝", "remote", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}, "error", errors.New("a b"))
+	as.Equal(buf.String(), "WARN 拒绝 remote=127.0.0.1:80 error=\"a b\"\n")
+
+	// 文件和行号是调用者的
+	buf.Reset()
+	lg = NewStdLogger(log.New(&buf, "", log.Lshortfile), LevelDebug)
+	lg.Log(LevelInfo, "直接")
+	inner := newLogger(lg, nil, "web")
+	inner.warn("警告")
+	inner.closed([2]int64{}, time.Now(), nil)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		as.True(strings.HasPrefix(line, "forward_test.go:"), line)
+	}
+
+	// JSON
+	buf.Reset()
+	lg = NewJSONLogger(&buf, LevelDebug)
+	lg.Log(LevelError, "失败", "conn", uint64(3), "duration", time.Second, "error", nil)
+	var m map[string]interface{}
+	as.NotError(json.Unmarshal(buf.Bytes(), &m))
+	as.Equal(m["level"], "error").Equal(m["msg"], "失败").Equal(m["conn"], float64(3)).Equal(m["duration"], "1s").Nil(m["error"])
+}
+
+func Test_L2D_Logger(t *testing.T) {
+	as := assert.New(t, true)
+
+	rl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer rl.Close()
+
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+	)
+	lines := func() []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		var ms []map[string]interface{}
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var m map[string]interface{}
+			if json.Unmarshal(line, &m) == nil {
+				ms = append(ms, m)
+			}
+		}
+		return ms
+	}
+
+	acl := new(ACL)
+	ld := &L2D{ACL: acl, Name: "web", Logger: NewJSONLogger(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	}), LevelDebug)}
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	b := []byte("logger")
+	conn.Write(b)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(conn, make([]byte, len(b)))
+	as.NotError(err)
+	conn.Close()
+
+	// 访问控制拒绝
+	as.NotError(acl.Deny("all"))
+	conn, err = net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Read(b)
+	conn.Close()
+
+	for i := 0; i < 100 && len(lines()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ms := lines()
+	as.Equal(len(ms), 2)
+	var closed, denied map[string]interface{}
+	for _, m := range ms {
+		as.Equal(m["rule"], "web")
+		switch m["level"] {
+		case "debug":
+			closed = m
+		case "warn":
+			denied = m
+		}
+	}
+	as.NotNil(closed).NotNil(denied)
+	as.Equal(closed["bytes_in"], float64(len(b))).Equal(closed["bytes_out"], float64(len(b)))
+	as.Equal(closed["target"], rl.Addr().String())
+	as.Equal(denied["msg"], "访问控制拒绝连接").Equal(denied["remote"], conn.LocalAddr().String())
+	as.True(closed["conn"] != denied["conn"])
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func Test_L2D_VerifyError(t *testing.T) {
+	as := assert.New(t, true)
+
+	rl := runServerTCP(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	defer rl.Close()
+
+	ld := &L2D{Logger: NewJSONLogger(io.Discard, LevelDebug)}
+	defer ld.Close()
+	listen := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}}
+	dial := &Addr{Network: "tcp", Local: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, Remote: rl.Addr()}
+	bridge, err := ld.Transport(listen, dial)
+	as.NotError(err)
+	defer bridge.Close()
+
+	// 出错时返回nil连接
+	bridge.Verify = func(lconn, rconn net.Conn) (net.Conn, net.Conn, error) {
+		lconn.Close()
+		rconn.Close()
+		return nil, nil, errors.New("拒绝")
+	}
+	goSwap(bridge)
+
+	addr := ld.listen.(net.Listener).Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	as.NotError(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	as.Error(err)
+	for i := 0; i < 100 && bridge.Stats().VerifyFailed == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	as.Equal(bridge.Stats().VerifyFailed, int64(1))
+}
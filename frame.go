@@ -0,0 +1,178 @@
+package vforward
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/456vv/vconnpool/v2"
+)
+
+// UDP通过TCP转发时，每个数据报前面加上2字节长度（大端序）
+const frameMaxSize = 65535
+
+var errFrameTooLarge = errors.New("vforward: 数据报超过帧最大长度")
+
+// frameConn 通过TCP转发数据报，每次 Write 写入一帧，每次 Read 读取一帧。
+// 数据报超过 Read 的缓冲时截断，同UDP
+type frameConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	head [2]byte
+	hn   int    // 已读取的长度字节
+	body []byte // 当前帧的数据报
+	bn   int    // 已读取的数据报字节，读取超时后可以继续读取
+	wbuf []byte
+}
+
+// RawConn 原连接
+func (T *frameConn) RawConn() net.Conn { return T.Conn }
+
+func newFrameConn(conn net.Conn) *frameConn {
+	return &frameConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (T *frameConn) Read(b []byte) (int, error) {
+	for T.hn < len(T.head) {
+		n, err := T.r.Read(T.head[T.hn:])
+		T.hn += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	size := int(binary.BigEndian.Uint16(T.head[:]))
+	if cap(T.body) < size {
+		T.body = make([]byte, size)
+	}
+	T.body = T.body[:size]
+	for T.bn < size {
+		n, err := T.r.Read(T.body[T.bn:])
+		T.bn += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	T.hn, T.bn = 0, 0
+	return copy(b, T.body), nil
+}
+
+func (T *frameConn) Write(b []byte) (int, error) {
+	if len(b) > frameMaxSize {
+		return 0, errFrameTooLarge
+	}
+	T.wbuf = append(T.wbuf[:0], byte(len(b)>>8), byte(len(b)))
+	T.wbuf = append(T.wbuf, b...)
+	if _, err := T.Conn.Write(T.wbuf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// unframeConn 把数据报连接转为帧的数据流，用于和TCP连接交换数据。
+// Read 每个数据报读取为一帧，Write 写入的数据流按帧拆分为数据报。
+// 设置了 idle 时，双方都没有数据超过 idle，Read 返回 io.EOF
+type unframeConn struct {
+	net.Conn
+	header []byte        // 每个数据报前面加上的PROXY协议头
+	idle   time.Duration // 空闲超时，0 不超时
+	active int64         // 最后活动时间，纳秒
+
+	rbuf    []byte // 读取的帧
+	roff    int
+	wbuf    []byte // 未完成的帧
+	scratch []byte
+}
+
+func newUnframeConn(conn net.Conn, header []byte, idle time.Duration) *unframeConn {
+	return &unframeConn{Conn: conn, header: header, idle: idle, active: time.Now().UnixNano()}
+}
+
+func (T *unframeConn) Read(b []byte) (int, error) {
+	if T.roff == len(T.rbuf) {
+		if T.rbuf == nil {
+			T.rbuf = make([]byte, 2+frameMaxSize)
+		}
+		buf := T.rbuf[:cap(T.rbuf)]
+		n, err := T.readPacket(buf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		T.rbuf, T.roff = buf[:2+n], 0
+	}
+	n := copy(b, T.rbuf[T.roff:])
+	T.roff += n
+	return n, nil
+}
+
+// readPacket 读取一个数据报，双方任一方有数据都算活动
+func (T *unframeConn) readPacket(b []byte) (int, error) {
+	if T.idle <= 0 {
+		return T.Conn.Read(b)
+	}
+	for {
+		active := time.Unix(0, atomic.LoadInt64(&T.active))
+		if err := T.Conn.SetReadDeadline(active.Add(T.idle)); err != nil {
+			return 0, err
+		}
+		n, err := T.Conn.Read(b)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&T.active))) < T.idle {
+				// 另一方仍在发送数据
+				continue
+			}
+			return 0, io.EOF
+		}
+		if err == nil {
+			atomic.StoreInt64(&T.active, time.Now().UnixNano())
+		}
+		return n, err
+	}
+}
+
+func (T *unframeConn) Write(b []byte) (int, error) {
+	atomic.StoreInt64(&T.active, time.Now().UnixNano())
+	T.wbuf = append(T.wbuf, b...)
+	for len(T.wbuf) >= 2 {
+		size := int(binary.BigEndian.Uint16(T.wbuf))
+		if len(T.wbuf) < 2+size {
+			break
+		}
+		p := T.wbuf[2 : 2+size]
+		if T.header != nil {
+			T.scratch = append(append(T.scratch[:0], T.header...), p...)
+			p = T.scratch
+		}
+		if _, err := T.Conn.Write(p); err != nil {
+			return 0, err
+		}
+		T.wbuf = T.wbuf[:copy(T.wbuf, T.wbuf[2+size:])]
+	}
+	return len(b), nil
+}
+
+// unframeDialer 发起数据报连接，转为帧的数据流
+type unframeDialer struct {
+	vconnpool.Dialer
+}
+
+func (T *unframeDialer) Dial(network, address string) (net.Conn, error) {
+	return T.DialContext(context.Background(), network, address)
+}
+
+func (T *unframeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := T.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if isStream(network) {
+		return conn, nil
+	}
+	return newUnframeConn(conn, nil, 0), nil
+}
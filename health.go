@@ -0,0 +1,176 @@
+package vforward
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-reuseport"
+)
+
+// HealthCheck 远程健康检查，包含主动探测和被动检测。
+// 被动检测：连续发起连接或验证失败 MaxFails 次，标记为不可用。
+// 主动探测：每隔 Interval 探测一次，不可用的远程连续探测成功 Rises 次，恢复可用。
+// UDP等无连接的远程发送空数据报探测，被拒绝（ICMP端口不可达）为失败，需要应用层的探测时设置 Probe。
+type HealthCheck struct {
+	Interval time.Duration                               // 主动探测间隔（默认：5s）
+	Timeout  time.Duration                               // 探测超时（默认：2s）
+	Probe    func(ctx context.Context, addr *Addr) error // 自定义探测，nil 使用连接探测
+	MaxFails int                                         // 连续失败次数达到后标记为不可用（默认：3）
+	Rises    int                                         // 不可用后连续探测成功次数达到后恢复可用（默认：2）
+}
+
+// 健康状态
+type health struct {
+	down  atomicBool // 不可用
+	fails int32      // 连续失败次数
+	rises int32      // 连续成功次数
+
+	probing atomicBool // 正在主动探测
+}
+
+// Healthy 是否可用
+//
+//	bool    可用
+func (T *health) Healthy() bool {
+	return T.down.isFalse()
+}
+
+func (T *HealthCheck) interval() time.Duration {
+	if T == nil || T.Interval <= 0 {
+		return 5 * time.Second
+	}
+	return T.Interval
+}
+
+func (T *HealthCheck) timeout() time.Duration {
+	if T.Timeout <= 0 {
+		return 2 * time.Second
+	}
+	return T.Timeout
+}
+
+func (T *HealthCheck) maxFails() int32 {
+	if T.MaxFails <= 0 {
+		return 3
+	}
+	return int32(T.MaxFails)
+}
+
+func (T *HealthCheck) rises() int32 {
+	if T.Rises <= 0 {
+		return 2
+	}
+	return int32(T.Rises)
+}
+
+// fail 记录一次失败，返回true表示由可用变为不可用
+func (T *HealthCheck) fail(h *health) bool {
+	if T == nil {
+		return false
+	}
+	atomic.StoreInt32(&h.rises, 0)
+	if atomic.AddInt32(&h.fails, 1) >= T.maxFails() {
+		return !h.down.setTrue()
+	}
+	return false
+}
+
+// succeed 记录一次成功，返回true表示由不可用变为可用
+func (T *HealthCheck) succeed(h *health) bool {
+	if T == nil {
+		return false
+	}
+	atomic.StoreInt32(&h.fails, 0)
+	if h.down.isFalse() {
+		return false
+	}
+	if atomic.AddInt32(&h.rises, 1) >= T.rises() {
+		atomic.StoreInt32(&h.rises, 0)
+		return !h.down.setFalse()
+	}
+	return false
+}
+
+func (T *HealthCheck) probe(addr *Addr) error {
+	ctx, cancel := context.WithTimeout(context.Background(), T.timeout())
+	defer cancel()
+	if T.Probe != nil {
+		return T.Probe(ctx, addr)
+	}
+	if !isStream(addr.Network) {
+		return probeDatagram(ctx, addr)
+	}
+	if isRUDP(addr.Network) {
+		conn, err := DialRUDP(ctx, addr.Network, addr.Remote.String(), nil)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	dialer := net.Dialer{
+		Control:   reuseport.Control,
+		LocalAddr: addr.Local,
+	}
+	conn, err := dialer.DialContext(ctx, addr.Network, addr.Remote.String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeDatagram 向无连接的远程发送空数据报，被拒绝为失败，有回应或超时没有回应为成功
+func probeDatagram(ctx context.Context, addr *Addr) error {
+	conn, err := connectUDP(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(nil); err != nil {
+		return err
+	}
+	// 回应可能很大，部分系统读取不完整时返回错误
+	if _, err = conn.Read(make([]byte, 64<<10)); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// check 执行一次探测并记录结果
+func (T *HealthCheck) check(h *health, addr *Addr, lg logger) {
+	if err := T.probe(addr); err != nil {
+		if T.fail(h) {
+			lg.warn("远程健康检查失败，标记为不可用", "target", addr.Remote, "error", err)
+		}
+		return
+	}
+	if T.succeed(h) {
+		lg.info("远程健康检查成功，恢复可用", "target", addr.Remote)
+	}
+}
+
+// run 定时主动探测，直到 closed 为真。上一次探测还没有结束的远程跳过本次探测
+func (T *HealthCheck) run(closed *atomicBool, lg logger, targets func(func(h *health, addr *Addr))) {
+	for {
+		time.Sleep(T.interval())
+		if closed.isTrue() {
+			return
+		}
+		targets(func(h *health, addr *Addr) {
+			if h.probing.setTrue() {
+				return
+			}
+			go func() {
+				defer h.probing.setFalse()
+				T.check(h, addr, lg)
+			}()
+		})
+	}
+}
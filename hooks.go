@@ -0,0 +1,77 @@
+package vforward
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// 接受的连接没有开始交换就结束的原因，见 Session.Err
+var (
+	errSwapClosed = errors.New("vforward: 交换已经关闭")
+	errVerify     = errors.New("vforward: 连接验证失败")
+	errNoRemote   = errors.New("vforward: 没有可用的远程地址")
+)
+
+// Hooks 连接生命周期的回调，用于审计和计费，不需要的回调可以为nil。
+// 回调在转发的协程中同步调用，耗时的处理需要另开协程
+type Hooks struct {
+	// OnAccept 接受的连接通过访问控制和连接限制之后调用，被拒绝的连接不调用任何回调。之后连接结束都会调用 OnClose。
+	// L2D为客户端连接或UDP会话，L2L为A方或B方的连接，local 是监听地址
+	OnAccept func(local, remote net.Addr)
+	// OnDial 发起连接结束后调用，err 为nil时成功。
+	// L2D为每次尝试的远程，D2D为向A方或B方发起的连接
+	OnDial func(network, addr string, latency time.Duration, err error)
+	// OnPair D2D和L2L的A方和B方配对成功，开始交换时调用
+	OnPair func(s *Session)
+	// OnClose 交换结束，双方连接关闭后调用。L2D的UDP会话为会话结束。
+	// 接受的连接验证或发起连接失败时也调用，Session.Err 为原因，没有远程或对方的地址为nil
+	OnClose func(s *Session)
+}
+
+// Session 一次交换的信息
+type Session struct {
+	A, B     net.Addr      // 双方的对端地址，L2D为客户端和远程，D2D和L2L为A方和B方
+	Start    time.Time     // 开始的时间，L2D为接受连接，D2D和L2L为配对
+	BytesIn  int64         // 上行字节数，OnClose 时有效
+	BytesOut int64         // 下行字节数，OnClose 时有效
+	Duration time.Duration // 交换的时长，OnClose 时有效
+	Err      error         // 结束交换的错误，正常结束为nil，OnClose 时有效
+}
+
+func (T *Hooks) accept(local, remote net.Addr) {
+	if T != nil && T.OnAccept != nil {
+		T.OnAccept(local, remote)
+	}
+}
+
+func (T *Hooks) dial(network, addr string, latency time.Duration, err error) {
+	if T != nil && T.OnDial != nil {
+		T.OnDial(network, addr, latency, err)
+	}
+}
+
+// pair 开始交换，返回交换的信息，结束时传给 close
+func (T *Hooks) pair(a, b net.Addr, notify bool) *Session {
+	if T == nil || T.OnPair == nil && T.OnClose == nil {
+		return nil
+	}
+	s := &Session{A: a, B: b, Start: time.Now()}
+	if notify && T.OnPair != nil {
+		T.OnPair(s)
+	}
+	return s
+}
+
+// close 交换结束
+func (T *Hooks) close(s *Session, bytes [2]int64, err error) {
+	if s == nil || T.OnClose == nil {
+		return
+	}
+	// 使用副本，OnPair 可能保留了开始时的信息
+	c := *s
+	c.BytesIn, c.BytesOut = bytes[dirUp], bytes[dirDown]
+	c.Duration = time.Since(c.Start)
+	c.Err = err
+	T.OnClose(&c)
+}
@@ -0,0 +1,514 @@
+package vforward
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 修改 X-Forwarded-For 的方式
+const (
+	ForwardedAppend  = 1 // 在客户端发来的值后面追加客户端IP
+	ForwardedReplace = 2 // 替换为客户端IP，用于不信任客户端的值
+)
+
+// HTTP请求头最大长度
+const httpMaxHeader = 16 << 10
+
+var errHTTPRequest = errors.New("vforward: 不是有效的HTTP请求，已经修改过请求头的连接不能原样转发")
+
+// HTTPRouter 按HTTP/1.x请求的 Host 选择远程，可以在每个请求中加入 X-Forwarded-For 和 X-Forwarded-Proto。
+// 同一个连接只按第一个请求选择远程。不是HTTP的数据，以及升级协议（CONNECT，Upgrade）成功之后的数据原样转发。
+// 需要修改请求头时，第一个请求不是HTTP的数据或格式错误同样原样转发，
+// 之后的请求不是HTTP的数据或格式错误直接关闭连接，防止之后的请求绕过修改。
+type HTTPRouter struct {
+	Timeout         time.Duration // 读取第一个请求头超时（默认：5s）
+	Default         *Remotes      // 默认路由（默认：nil，使用 Transport 的远程）
+	XForwardedFor   int           // 修改 X-Forwarded-For，ForwardedAppend 或 ForwardedReplace（默认：0，不修改）
+	XForwardedProto string        // 设置 X-Forwarded-Proto，如 http，https（默认：空，不修改）
+
+	table hostTable
+}
+
+// Add 添加路由
+//
+//	host string     主机名，不含端口，*.example.com 匹配全部子域名，* 匹配全部主机名
+//	rs *Remotes     远程
+func (T *HTTPRouter) Add(host string, rs *Remotes) {
+	T.table.add(host, rs, nil)
+}
+
+// Remotes 路由中的全部远程
+//
+//	[]*Remotes  远程
+func (T *HTTPRouter) Remotes() []*Remotes {
+	rss := T.table.remotes()
+	if T.Default != nil {
+		rss = append(rss, T.Default)
+	}
+	return rss
+}
+
+// Route 选择远程，见 Router
+func (T *HTTPRouter) Route(conn net.Conn) (net.Conn, *Remotes, error) {
+	if err := conn.SetReadDeadline(peekTimeout(T.Timeout)); err != nil {
+		return nil, nil, err
+	}
+	hc := &httpConn{
+		Conn:   conn,
+		r:      bufio.NewReaderSize(conn, httpMaxHeader),
+		router: T,
+		client: addrHost(conn.RemoteAddr()),
+		closed: make(chan struct{}),
+	}
+	if err := hc.readRequest(); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, nil, err
+		}
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	host := hc.host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if rs := T.table.lookup(strings.Trim(host, "[]"), nil); rs != nil {
+		return hc, rs, nil
+	}
+	return hc, T.Default, nil
+}
+
+// 需要修改请求头
+func (T *HTTPRouter) rewrite() bool {
+	return T.XForwardedFor != 0 || T.XForwardedProto != ""
+}
+
+// httpConn 读取时修改每个请求的请求头
+type httpConn struct {
+	net.Conn
+	r      *bufio.Reader
+	router *HTTPRouter
+	client string // 客户端IP
+	host   string // 第一个请求的 Host
+
+	buf     []byte // 待读取的数据
+	remain  int64  // 请求体或当前块剩余长度
+	chunked bool   // 分块请求体
+	trailer bool   // 分块请求体的尾部
+	raw     bool   // 原样转发
+	rewrote bool   // 已经修改过请求头，之后不能原样转发
+
+	wait chan bool // 等待远程对升级协议请求的响应，true 为升级成功
+
+	mu        sync.Mutex
+	resp      httpResponse // 远程的响应
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// RawConn 原连接
+func (T *httpConn) RawConn() net.Conn { return T.Conn }
+
+func (T *httpConn) Read(b []byte) (int, error) {
+	for {
+		switch {
+		case len(T.buf) != 0:
+			n := copy(b, T.buf)
+			T.buf = T.buf[n:]
+			return n, nil
+		case T.raw:
+			return T.r.Read(b)
+		case T.remain > 0:
+			if int64(len(b)) > T.remain {
+				b = b[:T.remain]
+			}
+			n, err := T.r.Read(b)
+			T.remain -= int64(n)
+			return n, err
+		case T.chunked:
+			if err := T.readChunk(); err != nil {
+				return 0, err
+			}
+		case T.wait != nil:
+			// 远程响应之前不能确定之后的数据是否还是HTTP请求
+			select {
+			case T.raw = <-T.wait:
+				T.wait = nil
+			case <-T.closed:
+				return 0, net.ErrClosed
+			}
+		default:
+			if err := T.readRequest(); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// Write 写入远程的响应，确定升级协议是否成功
+func (T *httpConn) Write(b []byte) (int, error) {
+	T.mu.Lock()
+	T.resp.parse(b)
+	T.mu.Unlock()
+	return T.Conn.Write(b)
+}
+
+// Close 关闭连接，结束等待升级协议的响应
+func (T *httpConn) Close() error {
+	T.closeOnce.Do(func() { close(T.closed) })
+	return T.Conn.Close()
+}
+
+// readRequest 读取并修改请求头，不是HTTP请求转为原样转发，已经修改过请求头时返回错误
+func (T *httpConn) readRequest() error {
+	var head []byte
+	fallback := func(err error) error {
+		if T.rewrote {
+			// 原样转发之后的请求就不再修改请求头
+			return errHTTPRequest
+		}
+		T.buf = append(T.buf, head...)
+		T.raw = true
+		T.mu.Lock()
+		T.resp.fail()
+		T.mu.Unlock()
+		if len(T.buf) != 0 {
+			return nil
+		}
+		return err
+	}
+
+	b, err := T.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if b[0] < 'A' || b[0] > 'Z' {
+		return fallback(nil)
+	}
+	line, err := T.r.ReadSlice('\n')
+	head = append(head, line...)
+	if err != nil {
+		return fallback(err)
+	}
+	method, ok := parseRequestLine(line)
+	if !ok {
+		return fallback(nil)
+	}
+
+	var (
+		out                 = append([]byte{}, line...)
+		contentLength int64 = -1
+		chunked       bool
+		upgrade       bool
+		forwarded     []string
+	)
+	for {
+		line, err = T.r.ReadSlice('\n')
+		head = append(head, line...)
+		if err != nil {
+			return fallback(err)
+		}
+		text := bytes.TrimRight(line, "\r\n")
+		if len(text) == 0 {
+			break
+		}
+		i := bytes.IndexByte(text, ':')
+		if i <= 0 {
+			return fallback(nil)
+		}
+		value := strings.TrimSpace(string(text[i+1:]))
+		switch strings.ToLower(string(text[:i])) {
+		case "host":
+			if T.host == "" {
+				T.host = value
+			}
+		case "content-length":
+			// 重复的长度可能被远程按不同的值解析，造成请求走私
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 || contentLength != -1 {
+				return fallback(nil)
+			}
+			contentLength = n
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case "connection":
+			upgrade = upgrade || strings.Contains(strings.ToLower(value), "upgrade")
+		case "x-forwarded-for":
+			if T.router.XForwardedFor != 0 {
+				forwarded = append(forwarded, value)
+				continue
+			}
+		case "x-forwarded-proto":
+			if T.router.XForwardedProto != "" {
+				continue
+			}
+		}
+		out = append(out, line...)
+	}
+
+	if T.router.XForwardedFor != 0 && T.client != "" {
+		if T.router.XForwardedFor == ForwardedReplace {
+			forwarded = nil
+		}
+		forwarded = append(forwarded, T.client)
+		out = append(out, "X-Forwarded-For: "+strings.Join(forwarded, ", ")+"\r\n"...)
+	}
+	if T.router.XForwardedProto != "" {
+		out = append(out, "X-Forwarded-Proto: "+T.router.XForwardedProto+"\r\n"...)
+	}
+	if chunked && contentLength != -1 {
+		return fallback(nil)
+	}
+	out = append(out, line...)
+	T.buf = append(T.buf, out...)
+
+	if !T.router.rewrite() {
+		// 不需要修改
+		T.raw = true
+		T.mu.Lock()
+		T.resp.fail()
+		T.mu.Unlock()
+		return nil
+	}
+	T.rewrote = true
+	T.mu.Lock()
+	T.resp.methods = append(T.resp.methods, method)
+	if method == "CONNECT" || upgrade {
+		// 远程响应成功之后不再是HTTP请求，等待期间不读取之后的请求，所以是最后一个请求
+		T.wait = make(chan bool, 1)
+		T.resp.pending, T.resp.connect = T.wait, method == "CONNECT"
+	}
+	T.mu.Unlock()
+	if chunked {
+		T.chunked = true
+	} else if contentLength > 0 {
+		T.remain = contentLength
+	}
+	return nil
+}
+
+// readChunk 读取分块请求体的块长度行，块数据由 remain 原样转发
+func (T *httpConn) readChunk() error {
+	line, err := T.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return errHTTPRequest
+	}
+	T.buf = append(T.buf, line...)
+	if err != nil {
+		if len(T.buf) != 0 {
+			return nil
+		}
+		return err
+	}
+	text := bytes.TrimRight(line, "\r\n")
+	if T.trailer {
+		if len(text) == 0 {
+			T.chunked, T.trailer = false, false
+		}
+		return nil
+	}
+	if i := bytes.IndexByte(text, ';'); i != -1 {
+		text = text[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(text)), 16, 64)
+	if err != nil || size < 0 {
+		return errHTTPRequest
+	}
+	if size == 0 {
+		T.trailer = true
+		return nil
+	}
+	// 块数据和结尾的CRLF
+	T.remain = size + 2
+	return nil
+}
+
+// 远程响应的解析状态
+const (
+	respStatus  = iota // 状态行
+	respHeader         // 响应头
+	respBody           // 固定长度的响应体或块数据
+	respChunk          // 块长度行
+	respTrailer        // 分块响应体的尾部
+	respRaw            // 不再解析，升级协议成功，或无法确定响应的边界
+)
+
+// httpResponse 按顺序解析远程的响应，找出升级协议请求的响应。
+// 响应可能分多次写入，前面还可能有之前请求的响应
+type httpResponse struct {
+	methods []string  // 已转发还没有响应的请求方法
+	pending chan bool // 等待升级协议请求的响应，收到时通知
+	connect bool      // 等待的是 CONNECT 请求
+
+	state   int
+	line    []byte // 不完整的行
+	code    int    // 当前响应的状态码
+	length  int64  // 当前响应的 Content-Length，没有为-1
+	chunked bool   // 当前响应是分块的
+	remain  int64  // 响应体或当前块剩余长度
+}
+
+// parse 解析写入客户端的数据
+func (T *httpResponse) parse(b []byte) {
+	for len(b) != 0 && T.state != respRaw {
+		if T.state == respBody {
+			n := int64(len(b))
+			if n > T.remain {
+				n = T.remain
+			}
+			b = b[n:]
+			if T.remain -= n; T.remain == 0 {
+				T.state = respStatus
+				if T.chunked {
+					T.state = respChunk
+				}
+			}
+			continue
+		}
+		i := bytes.IndexByte(b, '\n')
+		n := i + 1
+		if i == -1 {
+			n = len(b)
+		}
+		if len(T.line)+n > httpMaxHeader {
+			T.fail()
+			return
+		}
+		T.line = append(T.line, b[:n]...)
+		b = b[n:]
+		if i == -1 {
+			return
+		}
+		T.parseLine(bytes.TrimRight(T.line, "\r\n"))
+		T.line = T.line[:0]
+	}
+}
+
+// parseLine 解析一行，不含结尾的CRLF
+func (T *httpResponse) parseLine(text []byte) {
+	switch T.state {
+	case respStatus:
+		code, ok := parseStatusCode(text)
+		if !ok {
+			T.fail()
+			return
+		}
+		T.state, T.code, T.length, T.chunked = respHeader, code, -1, false
+	case respHeader:
+		if len(text) == 0 {
+			T.end()
+			return
+		}
+		i := bytes.IndexByte(text, ':')
+		if i <= 0 {
+			return
+		}
+		value := strings.TrimSpace(string(text[i+1:]))
+		switch strings.ToLower(string(text[:i])) {
+		case "content-length":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+				T.length = n
+			}
+		case "transfer-encoding":
+			T.chunked = strings.Contains(strings.ToLower(value), "chunked")
+		}
+	case respChunk:
+		if i := bytes.IndexByte(text, ';'); i != -1 {
+			text = text[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(text)), 16, 64)
+		if err != nil || size < 0 {
+			T.fail()
+			return
+		}
+		if size == 0 {
+			T.state = respTrailer
+			return
+		}
+		// 块数据和结尾的CRLF
+		T.state, T.remain = respBody, size+2
+	case respTrailer:
+		if len(text) == 0 {
+			T.state = respStatus
+		}
+	}
+}
+
+// end 响应头结束，对应到请求，确定响应体的长度
+func (T *httpResponse) end() {
+	if T.code/100 == 1 && T.code != 101 {
+		// 100 Continue 等中间响应，之后还有最终响应
+		T.state = respStatus
+		return
+	}
+	var method string
+	if len(T.methods) != 0 {
+		method, T.methods = T.methods[0], T.methods[1:]
+	}
+	if T.pending != nil && len(T.methods) == 0 {
+		ok := T.code == 101
+		if T.connect {
+			ok = T.code/100 == 2
+		}
+		T.pending <- ok
+		T.pending = nil
+		if ok {
+			T.state = respRaw
+			return
+		}
+	}
+	switch {
+	case T.code == 101:
+		// 没有请求升级协议
+		T.fail()
+	case method == "HEAD" || T.code == 204 || T.code == 304:
+		T.state = respStatus
+	case T.chunked:
+		T.state = respChunk
+	case T.length > 0:
+		T.state, T.remain = respBody, T.length
+	case T.length == 0:
+		T.state = respStatus
+	default:
+		// 响应体直到连接关闭
+		T.fail()
+	}
+}
+
+// fail 不再解析，等待中的升级协议请求按失败处理
+func (T *httpResponse) fail() {
+	T.state, T.line = respRaw, nil
+	if T.pending != nil {
+		T.pending <- false
+		T.pending = nil
+	}
+}
+
+// parseRequestLine 解析请求行，返回方法
+func parseRequestLine(line []byte) (string, bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/1.") {
+		return "", false
+	}
+	for _, c := range fields[0] {
+		if c < 'A' || c > 'Z' {
+			return "", false
+		}
+	}
+	return fields[0], true
+}
+
+// parseStatusCode 解析响应的状态码
+func parseStatusCode(b []byte) (int, bool) {
+	if len(b) < 12 || !bytes.HasPrefix(b, []byte("HTTP/1.")) || b[8] != ' ' {
+		return 0, false
+	}
+	code, err := strconv.Atoi(string(b[9:12]))
+	return code, err == nil
+}
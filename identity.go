@@ -0,0 +1,152 @@
+package vforward
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// IdentityMap 客户端证书身份映射，证书的CN或SAN（DNS，Email，URI，IP）映射为身份名称。
+// 设置了映射时，没有对应身份的证书将被拒绝。
+type IdentityMap struct {
+	names map[string]string
+	mu    sync.RWMutex
+}
+
+// ParseIdentityMap 读取身份映射，每行一条，# 开头为注释。
+//
+//	client1.example.com   client1
+//	ops@example.com       ops
+//
+//	r io.Reader     映射
+//	*IdentityMap    身份映射
+//	error           错误
+func ParseIdentityMap(r io.Reader) (*IdentityMap, error) {
+	im := new(IdentityMap)
+	scan := bufio.NewScanner(r)
+	for line := 1; scan.Scan(); line++ {
+		text := strings.TrimSpace(scan.Text())
+		if i := strings.Index(text, "#"); i != -1 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("vforward: 身份映射第%d行格式错误 %q", line, text)
+		}
+		im.Set(fields[0], fields[1])
+	}
+	return im, scan.Err()
+}
+
+// LoadIdentityMap 从文件读取身份映射，格式见 ParseIdentityMap
+//
+//	file string     文件路径
+//	*IdentityMap    身份映射
+//	error           错误
+func LoadIdentityMap(file string) (*IdentityMap, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseIdentityMap(f)
+}
+
+// Set 设置映射
+//
+//	subject string      证书的CN或SAN
+//	identity string     身份名称
+func (T *IdentityMap) Set(subject, identity string) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	if T.names == nil {
+		T.names = make(map[string]string)
+	}
+	T.names[subject] = identity
+}
+
+// identity 证书对应的身份，IdentityMap为nil时使用CN
+func (T *IdentityMap) identity(cert *x509.Certificate) (string, bool) {
+	if T == nil {
+		return cert.Subject.CommonName, true
+	}
+	subjects := []string{cert.Subject.CommonName}
+	subjects = append(subjects, cert.DNSNames...)
+	subjects = append(subjects, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		subjects = append(subjects, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		subjects = append(subjects, ip.String())
+	}
+	T.mu.RLock()
+	defer T.mu.RUnlock()
+	for _, s := range subjects {
+		if id, ok := T.names[s]; ok && s != "" {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// identityConn 已确认身份的TLS连接
+type identityConn struct {
+	net.Conn
+	identity string
+}
+
+// RawConn 原连接
+func (T *identityConn) RawConn() net.Conn { return T.Conn }
+
+// ConnectionState 连接的TLS状态
+func (T *identityConn) ConnectionState() tls.ConnectionState {
+	return T.Conn.(*tls.Conn).ConnectionState()
+}
+
+// identify 按客户端证书确认身份，没有客户端证书的连接原样返回
+func identify(conn net.Conn, im *IdentityMap) (net.Conn, error) {
+	tconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return conn, nil
+	}
+	certs := tconn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		if im != nil {
+			return nil, errors.New("vforward: 没有客户端证书")
+		}
+		return conn, nil
+	}
+	id, ok := im.identity(certs[0])
+	if !ok {
+		return nil, fmt.Errorf("vforward: 证书 %q 没有对应的身份", certs[0].Subject.CommonName)
+	}
+	return &identityConn{Conn: conn, identity: id}, nil
+}
+
+// ConnIdentity 连接对方的身份，来自客户端证书，可以在 Verify 中使用。没有身份返回空
+//
+//	conn net.Conn   连接，可以是连接池中取出的连接
+//	string          身份
+func ConnIdentity(conn net.Conn) string {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *identityConn:
+			return c.identity
+		case interface{ RawConn() net.Conn }:
+			conn = c.RawConn()
+		default:
+			return ""
+		}
+	}
+	return ""
+}
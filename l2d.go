@@ -2,10 +2,12 @@ package vforward
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,13 +19,16 @@ import (
 type L2DSwap struct {
 	Verify      func(lconn, rconn net.Conn) (net.Conn, net.Conn, error) // 数据交换前对双方连接操作，可以现实验证之类
 	ld          *L2D                                                    // 引用父结构体 L2D
-	dialer      net.Dialer                                              // 连接拨号
-	raddr       *Addr                                                   // 远程地址
+	remotes     *Remotes                                                // 远程地址组
 	currUseConn int32                                                   // 当前使用连接数量
 	conns       vmap.Map                                                // 连接存储，方便关闭已经连接的连接
+	sessions    *udpSessions                                            // UDP会话
 
-	used atomicBool // 正在使用
-	exit chan bool
+	used  atomicBool // 正在使用
+	exit  chan bool
+	bufs  sync.Pool  // UDP数据报缓冲
+	rate  rateScope  // 带宽限制
+	stats *swapStats // 统计
 }
 
 // 当前连接数量
@@ -39,18 +44,41 @@ func (T *L2DSwap) ConnNum() int {
 	return (i / 2) + (i % 2)
 }
 
-// tcp
-func (T *L2DSwap) connRemoteTCP(lconn net.Conn) {
+// connRemoteTCP 向远程发起连接并交换数据
+//
+//	lg logger       连接的日志
+//	lconn net.Conn  客户端连接
+//	s *Session      回调的会话信息，连接远程成功后设置 B
+//	n [2]int64      上行，下行字节数
+//	err error       结束的原因，正常结束为nil
+func (T *L2DSwap) connRemoteTCP(lg logger, lconn net.Conn, s *Session) (n [2]int64, err error) {
 	// 交换被关闭
 	if T.used.isFalse() {
+		atomic.AddInt64(&T.stats.rejected, 1)
 		lconn.Close()
-		return
+		return n, errSwapClosed
 	}
 
 	// 计数连接数
 	atomic.AddInt32(&T.currUseConn, 2)
 	defer atomic.AddInt32(&T.currUseConn, -2)
 
+	// 按连接内容选择远程
+	remotes := T.remotes
+	if T.ld.Router != nil {
+		conn, rs, err := T.ld.Router.Route(lconn)
+		if err != nil {
+			lg.warn("路由失败", "error", err)
+			atomic.AddInt64(&T.stats.failed, 1)
+			lconn.Close()
+			return n, err
+		}
+		lconn = conn
+		if rs != nil {
+			remotes = rs
+		}
+	}
+
 	var (
 		ctx    = T.ld.Context
 		cancel context.CancelFunc
@@ -63,30 +91,88 @@ func (T *L2DSwap) connRemoteTCP(lconn net.Conn) {
 		defer cancel()
 	}
 
-	rconn, err := T.dialer.DialContext(ctx, T.raddr.Network, T.raddr.Remote.String())
-	if err != nil {
+	// PROXY协议头，携带客户端地址
+	var header []byte
+	if T.ld.ProxyProtocol != 0 {
+		header, err = proxyHeader(T.ld.ProxyProtocol, lconn.RemoteAddr(), lconn.LocalAddr())
+		if err != nil {
+			lg.error("生成PROXY协议头失败", "error", err)
+			atomic.AddInt64(&T.stats.failed, 1)
+			lconn.Close()
+			return n, err
+		}
+	}
+
+	// 按顺序尝试远程，直到连接成功或超时
+	var (
+		rconn net.Conn
+		raddr *Remote
+		first *Remote
+		tried = make(map[*Remote]bool)
+	)
+	for {
+		raddr = remotes.pick(lconn.RemoteAddr(), func(r *Remote) bool { return tried[r] })
+		if raddr == nil {
+			break
+		}
+		if first == nil {
+			first = raddr
+		}
+		start := time.Now()
+		rconn, err = T.ld.dial(ctx, raddr, header)
+		T.ld.Hooks.dial(raddr.Network, raddr.Remote.String(), time.Since(start), err)
+		if err == nil {
+			T.stats.dial(time.Since(start))
+			break
+		}
+		T.stats.dialError(err)
+		lg.warn("向远程发起连接失败", "target", raddr.Remote, "error", err)
+		T.ld.healthFail(raddr)
+		raddr.release()
+		tried[raddr] = true
+		raddr = nil
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if raddr == nil {
 		// 远程连接不通，关闭请求连接
 		lconn.Close()
-		T.ld.logf("本地 %s 向远程 %s 发起请求失败: %v", T.raddr.Local.String(), T.raddr.Remote.String(), err)
-		return
+		lg.error("没有可用的远程地址")
+		atomic.AddInt64(&T.stats.failed, 1)
+		if err == nil {
+			err = errNoRemote
+		}
+		return n, err
+	}
+	defer raddr.release()
+	if s != nil {
+		s.B = rconn.RemoteAddr()
 	}
+	T.ld.failover(remotes, first, raddr)
 
 	if T.ld.bverify != nil && !T.ld.bverify(rconn) {
-		T.ld.logf("%s 连接验证失败", rconn.RemoteAddr().String())
+		lg.warn("远程连接验证失败", "target", rconn.RemoteAddr())
+		atomic.AddInt64(&T.stats.verifyFailed, 1)
 		lconn.Close()
 		rconn.Close()
-		return
+		T.ld.healthFail(raddr)
+		return n, errVerify
 	}
+	T.ld.HealthCheck.succeed(&raddr.health)
 	// 记录连接
 	T.conns.Set(lconn, rconn)
 	defer T.conns.Del(lconn)
 
 	//----------------------------
 	if T.Verify != nil {
+		// Verify 出错时返回的连接可能为nil
+		target := rconn.RemoteAddr()
 		lconn, rconn, err = T.Verify(lconn, rconn)
 		if err != nil {
-			T.ld.logf("验证失败: %s", err)
-			return
+			lg.warn("验证失败", "target", target, "error", err)
+			atomic.AddInt64(&T.stats.verifyFailed, 1)
+			return n, err
 		}
 	}
 
@@ -96,101 +182,292 @@ func (T *L2DSwap) connRemoteTCP(lconn net.Conn) {
 		bufSize = DefaultReadBufSize
 	}
 
-	go func() {
-		copyData(rconn, lconn, bufSize)
-		rconn.Close()
-	}()
-	copyData(lconn, rconn, bufSize)
-	lconn.Close()
+	// 带宽限制
+	if rate := T.ld.RateLimit.acquire(lconn.RemoteAddr(), &T.rate); rate != nil {
+		defer rate.release()
+		lconn, rconn = newRateConn(lconn, rate, dirUp), newRateConn(rconn, rate, dirDown)
+	}
+
+	start := time.Now()
+	n, err = swapData(lconn, rconn, bufSize, T.ld.HalfCloseTimeout, &T.stats.bytes)
+	atomic.AddInt64(&T.stats.completed, 1)
+	lg.with("target", raddr.Remote).closed(n, start, err)
+	return n, err
 }
 
 type readWriteReply struct {
-	lconn net.PacketConn // upd连接
-	laddr net.Addr
-
-	rconn net.Conn // 远程连接可能是tcp 或 udp
+	sentPackets int64 // 客户端发往远程
+	sentBytes   int64
+	recvPackets int64 // 远程回应客户端
+	recvBytes   int64
+	active      int64 // 最后活动时间，纳秒
+
+	key     string // 会话表中的键
+	created time.Time
+	lconn   net.PacketConn // upd连接
+	laddr   net.Addr
+
+	rconn   net.Conn  // 远程连接可能是tcp 或 udp
+	remote  *Remote   // 远程地址
+	release func()    // 释放连接限制
+	rate    *connRate // 带宽限制
+	stats   *swapStats
+	hook    *Session // 回调的会话信息
+	log     logger   // 会话的日志
+	header  []byte   // PROXY协议头，每个数据报前面加上
+	worker  int      // 写入协程
+
+	mu      sync.Mutex  // 保护发起连接期间的 rconn, remote, pending
+	pending []udpPacket // 发起连接期间暂存的数据报
 
 	closed atomicBool
 }
 
 func (rw *readWriteReply) Close() error {
+	// 和 connect 互斥，远程只由其中一方释放
+	rw.mu.Lock()
 	if rw.closed.setTrue() {
+		rw.mu.Unlock()
 		return nil
 	}
-	return rw.rconn.Close()
+	rconn, remote := rw.rconn, rw.remote
+	rw.pending = nil
+	rw.mu.Unlock()
+
+	rw.release()
+	if rw.rate != nil {
+		rw.rate.release()
+	}
+	if rconn == nil {
+		// 还在发起连接，连接成功后由 connect 关闭
+		return nil
+	}
+	remote.release()
+	return rconn.Close()
+}
+
+// connect 发起连接成功，转发暂存的数据报。会话已经关闭时关闭连接
+func (rw *readWriteReply) connect(rconn net.Conn, raddr *Remote, workers *udpWorkers) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed.isTrue() {
+		raddr.release()
+		rconn.Close()
+		return
+	}
+	rw.rconn, rw.remote = rconn, raddr
+	// 发起连接的时间不算空闲
+	rw.touch()
+	for _, p := range rw.pending {
+		workers.push(p)
+	}
+	rw.pending = nil
+}
+
+// touch 记录活动时间
+func (rw *readWriteReply) touch() {
+	atomic.StoreInt64(&rw.active, time.Now().UnixNano())
+}
+
+// idle 空闲时长
+func (rw *readWriteReply) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&rw.active)))
+}
+
+func (rw *readWriteReply) session() UDPSession {
+	var remote net.Addr
+	rw.mu.Lock()
+	if rw.rconn != nil {
+		remote = rw.rconn.RemoteAddr()
+	}
+	rw.mu.Unlock()
+	return UDPSession{
+		Client:      rw.laddr,
+		Remote:      remote,
+		Created:     rw.created,
+		Active:      time.Unix(0, atomic.LoadInt64(&rw.active)),
+		SentPackets: atomic.LoadInt64(&rw.sentPackets),
+		SentBytes:   atomic.LoadInt64(&rw.sentBytes),
+		RecvPackets: atomic.LoadInt64(&rw.recvPackets),
+		RecvBytes:   atomic.LoadInt64(&rw.recvBytes),
+	}
 }
 
 // udp
-func (T *L2DSwap) connReadReply(rw *readWriteReply) {
+func (T *L2DSwap) connReadReply(rw *readWriteReply, rconn net.Conn) {
 	// 设置缓冲区大小
 	bufSize := T.ld.ReadBufSize
 	if bufSize == 0 {
 		bufSize = DefaultReadBufSize
 	}
 
-	// 没有超时是危险的，连接不会断开，默认一分钟超时
-	timeout := T.ld.Timeout
-	if timeout == 0 {
-		timeout = time.Minute
-	}
+	timeout := T.ld.udpIdleTimeout()
 
 	defer atomic.AddInt32(&T.currUseConn, -2)
-	defer T.conns.Del(rw.laddr.String())
+	defer atomic.AddInt64(&T.stats.completed, 1)
+	defer T.sessions.remove(rw)
+	var rerr error
+	defer func() {
+		n := [2]int64{atomic.LoadInt64(&rw.sentBytes), atomic.LoadInt64(&rw.recvBytes)}
+		T.ld.Hooks.close(rw.hook, n, rerr)
+		rw.log.closed(n, rw.created, rerr)
+	}()
 	defer rw.Close()
 
+	// 回应按顺序写入，整个会话使用同一个缓冲
+	buf := T.bufs.Get().(*[]byte)
+	defer T.bufs.Put(buf)
 	for {
-		// 设置UDP读取超时，由于UDP是无连接，无法知道对方状态
-		if err := rw.rconn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		// 设置UDP读取超时，由于UDP是无连接，无法知道对方状态。双方任一方有数据都算活动
+		if err := rconn.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&rw.active)).Add(timeout)); err != nil {
 			break
 		}
 		// 读取数据
-		b := make([]byte, bufSize)
-		n, err := rw.rconn.Read(b)
+		n, err := rconn.Read(*buf)
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && rw.idle() < timeout && rw.closed.isFalse() {
+				// 客户端仍在发送数据
+				continue
+			}
 			if n > 0 {
-				T.ld.logf("转发过程 %s->%s 读取数据长度%d, 超出限制%d, 但返回错误: %v", rw.laddr.String(), rw.rconn.RemoteAddr().String(), n, bufSize, err)
+				rw.log.warn("读取远程回应的数据超出缓冲大小", "size", n, "buffer", bufSize, "error", err)
+			}
+			// 空闲超时和关闭会话不是错误
+			if ne, ok := err.(net.Error); !(ok && ne.Timeout()) && rw.closed.isFalse() {
+				rerr = err
 			}
 			break
 		}
 
-		go rw.lconn.WriteTo(b[:n], rw.laddr)
+		rw.touch()
+		if rw.rate != nil && !rw.rate.allowPacket(dirDown, n) {
+			// 超出带宽限制，丢弃
+			continue
+		}
+		if _, err := rw.lconn.WriteTo((*buf)[:n], rw.laddr); err == nil {
+			atomic.AddInt64(&rw.recvPackets, 1)
+			atomic.AddInt64(&rw.recvBytes, int64(n))
+			rw.stats.packet(dirDown, n)
+		}
 	}
 }
 
-func (T *L2DSwap) connRemoteUDP(b []byte, laddr net.Addr, lconn net.PacketConn) {
-	// 如果已经建立连接
-	if rw, ok := T.conns.Get(laddr.String()).(*readWriteReply); ok {
-		rw.rconn.Write(b)
-		return
+// connRemoteUDP 取得客户端的会话，没有则建立。不能建立返回nil
+func (T *L2DSwap) connRemoteUDP(laddr net.Addr, lconn net.PacketConn, workers *udpWorkers) *readWriteReply {
+	key := laddr.String()
+	rw := T.sessions.getOrCreate(key, func() *readWriteReply {
+		return T.newUDPSession(key, laddr, lconn, workers)
+	})
+	if rw != nil {
+		rw.touch()
 	}
+	return rw
+}
 
-	// 1,连接数量超过最大限制
-	// 2,交换已经关闭
-	// 3,交换不在使用状态
-	if (T.ld.maxConn != 0 && T.currUseConns() >= T.ld.maxConn) || T.used.isFalse() {
-		return
+// newUDPSession 建立会话，在会话表的锁中调用，同一个客户端只建立一次。
+// 向远程发起连接在另开的协程中进行，不阻塞其它客户端的数据报
+func (T *L2DSwap) newUDPSession(key string, laddr net.Addr, lconn net.PacketConn, workers *udpWorkers) *readWriteReply {
+	// 1,访问控制拒绝
+	// 2,连接数量超过最大限制
+	// 3,交换已经关闭
+	// 4,交换不在使用状态
+	if !T.ld.ACL.Permit(laddr) || (T.ld.maxConn != 0 && T.currUseConns() >= T.ld.maxConn) || T.used.isFalse() {
+		atomic.AddInt64(&T.stats.rejected, 1)
+		return nil
+	}
+
+	// 连接限制
+	release, err := T.ld.Limit.acquire(laddr)
+	if err != nil {
+		T.ld.Limit.logReject(T.ld.log().with("local", lconn.LocalAddr(), "remote", laddr), err)
+		atomic.AddInt64(&T.stats.rejected, 1)
+		return nil
 	}
 
 	// 计数连接数
 	atomic.AddInt32(&T.currUseConn, 2)
 
-	// 开始建立连接
-	rconn, err := connectUDP(T.raddr)
-	if err != nil {
-		T.ld.logf("本地UDP向远程 %v 发起请求失败: %v", T.raddr.Remote.String(), err)
-		atomic.AddInt32(&T.currUseConn, -2)
-		return
+	rw := &readWriteReply{
+		key:     key,
+		created: time.Now(),
+		active:  time.Now().UnixNano(),
+		lconn:   lconn,
+		laddr:   laddr,
+		release: release,
+		worker:  workers.assign(),
+		rate:    T.ld.RateLimit.acquire(laddr, &T.rate),
+		stats:   T.stats,
+		log:     T.ld.log().with("conn", nextConnID(), "local", lconn.LocalAddr(), "remote", laddr),
 	}
+	atomic.AddInt64(&T.stats.accepted, 1)
+	T.ld.Hooks.accept(lconn.LocalAddr(), laddr)
+	rw.hook = T.ld.Hooks.pair(laddr, nil, false)
 
-	rw := &readWriteReply{
-		lconn: lconn,
-		laddr: laddr,
-		rconn: rconn,
+	go T.dialUDPSession(rw, workers)
+	return rw
+}
+
+// dialUDPSession 按顺序尝试远程，成功后转发暂存的数据报并读取远程的回应
+func (T *L2DSwap) dialUDPSession(rw *readWriteReply, workers *udpWorkers) {
+	// PROXY协议头，UDP每个数据报前面加上，通过TCP转发时只在连接开始发送
+	var header []byte
+	if T.ld.ProxyProtocol != 0 {
+		header, _ = proxyHeader(T.ld.ProxyProtocol, rw.laddr, rw.lconn.LocalAddr())
 	}
-	T.conns.Set(laddr.String(), rw)
 
-	rconn.Write(b)
-	T.connReadReply(rw)
+	var (
+		rconn net.Conn
+		raddr *Remote
+		first *Remote
+		tried = make(map[*Remote]bool)
+		err   error
+	)
+	for {
+		raddr = T.remotes.pick(rw.laddr, func(r *Remote) bool { return tried[r] })
+		if raddr == nil {
+			rw.log.error("没有可用的远程地址")
+			atomic.AddInt32(&T.currUseConn, -2)
+			atomic.AddInt64(&T.stats.failed, 1)
+			T.sessions.remove(rw)
+			rw.Close()
+			if err == nil {
+				err = errNoRemote
+			}
+			T.ld.Hooks.close(rw.hook, [2]int64{}, err)
+			return
+		}
+		if first == nil {
+			first = raddr
+		}
+		start := time.Now()
+		if T.ld.UDPOverTCP && isStream(raddr.Network) {
+			rconn, err = T.ld.dialFrame(raddr, header)
+		} else {
+			rconn, err = T.ld.dialUDP(raddr.Addr)
+		}
+		T.ld.Hooks.dial(raddr.Network, raddr.Remote.String(), time.Since(start), err)
+		if err == nil {
+			T.stats.dial(time.Since(start))
+			break
+		}
+		T.stats.dialError(err)
+		rw.log.warn("向远程发起连接失败", "target", raddr.Remote, "error", err)
+		T.ld.healthFail(raddr)
+		raddr.release()
+		tried[raddr] = true
+	}
+	T.ld.failover(T.remotes, first, raddr)
+
+	rw.log = rw.log.with("target", raddr.Remote)
+	if rw.hook != nil {
+		rw.hook.B = rconn.RemoteAddr()
+	}
+	if _, ok := rconn.(*frameConn); !ok {
+		rw.header = header
+	}
+	// 会话已经关闭时 connect 关闭了连接，读取失败后结束会话
+	rw.connect(rconn, raddr, workers)
+	T.connReadReply(rw, rconn)
 }
 
 func (T *L2DSwap) keepAvailable() error {
@@ -209,7 +486,7 @@ func (T *L2DSwap) keepAvailable() error {
 				if tempDelay, ok = temporaryError(err, tempDelay, time.Second); ok {
 					continue
 				}
-				T.ld.logf("监听地址 %s， 并等待连接过程中失败: %v", l.Addr(), err)
+				T.ld.log().error("等待连接失败", "local", l.Addr(), "error", err)
 				return err
 			}
 			tempDelay = 0
@@ -222,43 +499,117 @@ func (T *L2DSwap) keepAvailable() error {
 		if bufSize == 0 {
 			bufSize = DefaultReadBufSize
 		}
-		for {
+		T.bufs.New = func() interface{} {
 			b := make([]byte, bufSize)
-			n, laddr, err := lconn.ReadFrom(b)
+			return &b
+		}
+		workers := newUDPWorkers(T.ld.UDPWorkers, T.ld.UDPQueue, &T.bufs)
+		defer workers.close()
+		for {
+			buf := T.bufs.Get().(*[]byte)
+			n, laddr, err := lconn.ReadFrom(*buf)
 			if err != nil {
+				T.bufs.Put(buf)
 				// 上级关闭了，子级也关闭
 				if T.ld.closed.isTrue() {
 					return T.Close()
 				}
 				if n > 0 {
-					T.ld.logf("监听地址 %s, 读取数据长度%d, 超出限制%d, 但返回错误: %v", lconn.LocalAddr(), n, bufSize, err)
+					T.ld.log().error("读取数据超出缓冲大小", "local", lconn.LocalAddr(), "size", n, "buffer", bufSize, "error", err)
 					return err
 				}
-				T.ld.logf("监听地址 %s, 并等待连接过程中失败: %v", lconn.LocalAddr(), err)
+				T.ld.log().error("等待数据失败", "local", lconn.LocalAddr(), "error", err)
 				return err
 			}
-			go T.connRemoteUDP(b[:n], laddr, lconn)
+			// 会话建立很快，在这里建立保证同一个客户端只有一个会话
+			rw := T.connRemoteUDP(laddr, lconn, workers)
+			if rw == nil || rw.rate != nil && !rw.rate.allowPacket(dirUp, n) {
+				T.bufs.Put(buf)
+				continue
+			}
+			workers.send(udpPacket{rw: rw, buf: buf, n: n})
 		}
 	}
 	return nil
 }
 
 func (T *L2DSwap) examineConn(conn net.Conn) {
+	// 读取PROXY协议头，之后使用协议头中的客户端地址
+	if T.ld.ProxyAccept != nil {
+		pconn, err := T.ld.ProxyAccept.accept(conn)
+		if err != nil {
+			T.ld.log().warn("读取PROXY协议头失败", "local", conn.LocalAddr(), "remote", conn.RemoteAddr(), "error", err)
+			atomic.AddInt64(&T.stats.rejected, 1)
+			conn.Close()
+			return
+		}
+		conn = pconn
+	}
+
+	lg := T.ld.log().with("conn", nextConnID(), "local", conn.LocalAddr(), "remote", conn.RemoteAddr())
+
+	// 访问控制
+	if !T.ld.ACL.Permit(conn.RemoteAddr()) {
+		lg.warn("访问控制拒绝连接")
+		atomic.AddInt64(&T.stats.rejected, 1)
+		conn.Close()
+		return
+	}
+
 	// 1,连接数量超过最大限制
 	// 2,交换已经关闭
 	// 3,交换不在使用状态
 	if (T.ld.maxConn != 0 && T.currUseConns() >= T.ld.maxConn) || T.used.isFalse() {
+		atomic.AddInt64(&T.stats.rejected, 1)
 		conn.Close()
 		return
 	}
 
+	// 连接限制
+	release, err := T.ld.Limit.acquire(conn.RemoteAddr())
+	if err != nil {
+		T.ld.Limit.logReject(lg, err)
+		atomic.AddInt64(&T.stats.rejected, 1)
+		conn.Close()
+		return
+	}
+	defer release()
+
+	// 通过访问控制和连接限制，之后连接结束都通知 OnClose，err 为结束的原因
+	atomic.AddInt64(&T.stats.accepted, 1)
+	T.ld.Hooks.accept(conn.LocalAddr(), conn.RemoteAddr())
+	var (
+		s = T.ld.Hooks.pair(conn.RemoteAddr(), nil, false)
+		n [2]int64
+	)
+	defer func() { T.ld.Hooks.close(s, n, err) }()
+
+	// TLS解密
+	if T.ld.TLSConfig != nil {
+		var tconn net.Conn
+		if tconn, err = tlsServer(conn, T.ld.TLSConfig); err != nil {
+			lg.warn("TLS握手失败", "error", err)
+			atomic.AddInt64(&T.stats.verifyFailed, 1)
+			conn.Close()
+			return
+		}
+		if conn, err = identify(tconn, T.ld.Identity); err != nil {
+			lg.warn("身份验证失败", "error", err)
+			atomic.AddInt64(&T.stats.verifyFailed, 1)
+			tconn.Close()
+			return
+		}
+	}
+
 	if T.ld.averify != nil && !T.ld.averify(conn) {
-		T.ld.logf("%s 连接验证失败", conn.RemoteAddr().String())
+		lg.warn("连接验证失败", "identity", ConnIdentity(conn))
+		atomic.AddInt64(&T.stats.verifyFailed, 1)
 		conn.Close()
+		err = errVerify
 		return
 	}
 
-	T.connRemoteTCP(conn)
+	n, err = T.connRemoteTCP(lg, conn, s)
 }
 
 // Swap 开始数据交换，当有TCP/UDP请求发来的时候，将会转发连接。
@@ -291,10 +642,60 @@ func (T *L2DSwap) Close() error {
 		return true
 	})
 	T.conns.Reset()
+	T.sessions.closeAll()
 	T.exit <- true
 	return nil
 }
 
+// Sessions UDP会话列表，最近有客户端数据的在前面
+//
+//	[]UDPSession    会话
+func (T *L2DSwap) Sessions() []UDPSession {
+	rws := T.sessions.list()
+	ss := make([]UDPSession, len(rws))
+	for i, rw := range rws {
+		ss[i] = rw.session()
+	}
+	return ss
+}
+
+// ExpireSession 关闭客户端的UDP会话
+//
+//	client net.Addr     客户端地址
+//	bool                会话存在
+func (T *L2DSwap) ExpireSession(client net.Addr) bool {
+	rw := T.sessions.find(client.String())
+	if rw == nil {
+		return false
+	}
+	T.sessions.remove(rw)
+	rw.Close()
+	return true
+}
+
+// ExpireIdle 关闭空闲超过 idle 的UDP会话
+//
+//	idle time.Duration  空闲时长
+//	int                 关闭的数量
+func (T *L2DSwap) ExpireIdle(idle time.Duration) int {
+	var n int
+	for _, rw := range T.sessions.list() {
+		if rw.idle() >= idle {
+			T.sessions.remove(rw)
+			rw.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// Stats 统计快照，可以在其它协程中调用
+//
+//	Stats       统计
+func (T *L2DSwap) Stats() Stats {
+	return T.stats.snapshot(T.ConnNum())
+}
+
 // L2D 是在内网或公网都可以使用，配合D2D或L2L使用功能更自由。L2D功能主要是转发连接（端口转发）。
 //
 //		-------------------------------------
@@ -303,11 +704,32 @@ func (T *L2DSwap) Close() error {
 //	 |     |  5→  |   |  6→  |     |（3，B然后再收到A数据）
 //		-------------------------------------
 type L2D struct {
-	maxConn     int           // 限制连接最大的数量
-	ReadBufSize int           // 交换数据缓冲大小
-	Timeout     time.Duration // TCP发起连接超时，udp远程读取超时(默认：60s)
-	ErrorLog    *log.Logger   // 日志
-	Context     context.Context
+	maxConn          int           // 限制连接最大的数量
+	ReadBufSize      int           // 交换数据缓冲大小
+	HalfCloseTimeout time.Duration // 一方结束后半关闭另一方，等待另一方向结束的时间，超时关闭双方。小于0 不半关闭，一方结束即关闭双方（默认：30s）
+	Timeout          time.Duration // TCP发起连接超时（默认：0，不超时，UDP会话通过TCP转发时使用 UDPIdleTimeout）
+	ErrorLog         *log.Logger   // 日志，没有设置 Logger 时使用，输出信息及以上级别
+	Logger           Logger        // 分级的结构化日志（默认：nil，使用 ErrorLog）
+	Name             string        // 规则名称，日志中的 rule 字段
+	Context          context.Context
+	HealthCheck      *HealthCheck           // 远程健康检查，不可用的远程将被跳过（默认：nil，不检查）
+	OnFailover       func(from, to *Remote) // 故障转移，远程 from 连接失败改用 to，或主备切换时调用
+	ACL              *ACL                   // 访问控制，TCP连接和UDP会话建立前检查（默认：nil，全部允许）
+	Limit            *ConnLimit             // 连接限制，TCP连接和UDP会话建立前检查（默认：nil，不限制）
+	RateLimit        *RateLimit             // 带宽限制，TCP连接和UDP会话（默认：nil，不限制）
+	Hooks            *Hooks                 // 连接生命周期的回调（默认：nil，不回调）
+	ProxyProtocol    int                    // 向远程发送PROXY协议头，携带客户端地址。ProxyProtocolV1 或 ProxyProtocolV2，UDP仅支持v2（默认：0，不发送）
+	ProxyAccept      *ProxyAccept           // 接收TCP连接的PROXY协议头，之后访问控制，验证和日志使用协议头中的客户端地址（默认：nil，不接收）
+	TLSConfig        *tls.Config            // 监听TCP连接使用TLS，解密后转发到远程（默认：nil，不加密）
+	RemoteTLS        *tls.Config            // 向远程发起TLS连接，握手和证书校验成功后才转发，见 NewTLSClientConfig（默认：nil，不加密）
+	UDPWorkers       int                    // UDP向远程写入数据报的协程数量，同一个会话按顺序写入（默认：CPU数量）
+	UDPQueue         int                    // UDP每个写入协程的队列长度，队列满时丢弃数据报（默认：1024）
+	Router           Router                 // 按连接内容选择远程，仅用于TCP，见 SNIRouter（默认：nil，使用 Transport 的远程）
+	Identity         *IdentityMap           // 客户端证书身份映射，没有对应身份的证书被拒绝，需要 TLSConfig 要求客户端证书（默认：nil，使用证书CN）
+	UDPIdleTimeout   time.Duration          // UDP会话空闲超时，双方都没有数据时关闭会话，UDPOverTCP 拆分为数据报的连接同样生效（默认：60s）
+	UDPMaxSessions   int                    // UDP最大会话数量，超过时关闭客户端最久没有发送数据的会话（默认：0，不限制）
+	UDPReply         int                    // UDP接收回应的来源，UDPReplySameIP 或 UDPReplyAny 使用未连接的UDP，用于从其它端口回应的协议（默认：UDPReplyConnected）
+	UDPOverTCP       bool                   // UDP通过TCP转发，数据报前面加上2字节长度。监听UDP时每个会话向TCP远程发起一个连接，监听TCP时连接的数据流拆分为数据报转发到UDP远程（默认：false）
 
 	listen interface{} // 监听
 
@@ -329,6 +751,22 @@ func (T *L2D) MaxConn(n int) {
 //	*L2DSwap    交换数据
 //	error       错误
 func (T *L2D) Transport(laddr, raddr *Addr) (*L2DSwap, error) {
+	return T.TransportRemotes(laddr, NewRemotes(BalanceRoundRobin, &Remote{Addr: raddr}))
+}
+
+// TransportRemotes 转发到多个远程地址，每个连接按 raddrs.Balance 策略选出一个远程地址。
+//
+//	laddr *Addr         监听IP地址
+//	raddrs *Remotes     远程地址组
+//	*L2DSwap            交换数据
+//	error               错误
+func (T *L2D) TransportRemotes(laddr *Addr, raddrs *Remotes) (*L2DSwap, error) {
+	if raddrs == nil || len(raddrs.List()) == 0 {
+		return nil, errors.New("vforward: 远程地址不能为空")
+	}
+	if T.ProxyProtocol == ProxyProtocolV1 && !isStream(laddr.Network) {
+		return nil, errors.New("vforward: PROXY协议v1不支持UDP")
+	}
 	if T.used.setTrue() {
 		return nil, errors.New("vforward: 不能重复调用 L2D.Transport")
 	}
@@ -340,16 +778,31 @@ func (T *L2D) Transport(laddr, raddr *Addr) (*L2DSwap, error) {
 	}
 
 	lds := &L2DSwap{
-		ld:    T,
-		raddr: raddr,
-		dialer: net.Dialer{
-			Control:   reuseport.Control,
-			LocalAddr: raddr.Local,
-		},
-		exit: make(chan bool),
+		ld:       T,
+		remotes:  raddrs,
+		exit:     make(chan bool),
+		sessions: newUDPSessions(T.UDPMaxSessions),
+		stats:    new(swapStats),
 	}
 	// 保持连接处于监听状态
 	go lds.keepAvailable()
+	if T.HealthCheck != nil {
+		go T.HealthCheck.run(&T.closed, T.log(), func(f func(*health, *Addr)) {
+			for _, r := range raddrs.List() {
+				f(&r.health, r.Addr)
+			}
+			if rr, ok := T.Router.(routerRemotes); ok {
+				for _, rs := range rr.Remotes() {
+					if rs == raddrs {
+						continue
+					}
+					for _, r := range rs.List() {
+						f(&r.health, r.Addr)
+					}
+				}
+			}
+		})
+	}
 	return lds, nil
 }
 
@@ -373,6 +826,101 @@ func (T *L2D) Close() error {
 	return nil
 }
 
-func (T *L2D) logf(format string, v ...interface{}) {
-	errLog(T.ErrorLog, format, v...)
+// 向远程发起TCP连接，先发送PROXY协议头，设置了 RemoteTLS 时再完成TLS握手。
+// 设置了 UDPOverTCP 并且远程是UDP时，连接的数据流按帧拆分为数据报转发
+func (T *L2D) dial(ctx context.Context, raddr *Remote, header []byte) (net.Conn, error) {
+	if T.UDPOverTCP && !isStream(raddr.Network) {
+		conn, err := T.dialUDP(raddr.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return newUnframeConn(conn, header, T.udpIdleTimeout()), nil
+	}
+	dialer := &net.Dialer{
+		Control:   reuseport.Control,
+		LocalAddr: raddr.Local,
+	}
+	conn, err := dialer.DialContext(ctx, raddr.Network, raddr.Remote.String())
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		if _, err = conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if T.RemoteTLS != nil {
+		return tlsClient(ctx, conn, T.RemoteTLS, raddr.Remote.String())
+	}
+	return conn, nil
+}
+
+// 向远程建立UDP会话，按 UDPReply 选择已连接或未连接的UDP
+func (T *L2D) dialUDP(addr *Addr) (net.Conn, error) {
+	if T.UDPReply != UDPReplyConnected {
+		if _, ok := addr.Remote.(*net.UDPAddr); ok {
+			return listenUDP(addr, T.UDPReply)
+		}
+	}
+	return connectUDP(addr)
+}
+
+// 向远程发起TCP连接，UDP会话的数据报按帧转发
+func (T *L2D) dialFrame(raddr *Remote, header []byte) (net.Conn, error) {
+	var (
+		ctx    = T.Context
+		cancel context.CancelFunc
+	)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// 没有设置超时也不能一直等待，会话的数据报在发起连接期间暂存
+	timeout := T.Timeout
+	if timeout == 0 {
+		timeout = T.udpIdleTimeout()
+	}
+	ctx, cancel = context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := T.dial(ctx, raddr, header)
+	if err != nil {
+		return nil, err
+	}
+	return newFrameConn(conn), nil
+}
+
+// UDP会话空闲超时，没有超时是危险的，连接不会断开，默认一分钟超时
+func (T *L2D) udpIdleTimeout() time.Duration {
+	if T.UDPIdleTimeout <= 0 {
+		return time.Minute
+	}
+	return T.UDPIdleTimeout
+}
+
+// 被动检测，记录远程失败
+func (T *L2D) healthFail(raddr *Remote) {
+	if T.HealthCheck.fail(&raddr.health) {
+		T.log().warn("远程连续失败，标记为不可用", "target", raddr.Remote)
+	}
+}
+
+// 故障转移，报告远程切换
+func (T *L2D) failover(rs *Remotes, first, raddr *Remote) {
+	from := first
+	if rs.Balance == BalanceFailover {
+		if prev := rs.setActive(raddr); prev != nil {
+			from = prev
+		}
+	}
+	if from == raddr {
+		return
+	}
+	T.log().info("远程故障转移", "from", from.Remote, "target", raddr.Remote)
+	if T.OnFailover != nil {
+		T.OnFailover(from, raddr)
+	}
+}
+
+func (T *L2D) log() logger {
+	return newLogger(T.Logger, T.ErrorLog, T.Name)
 }
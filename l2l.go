@@ -1,6 +1,7 @@
 package vforward
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -19,6 +20,7 @@ type L2LSwap struct {
 	conns  vmap.Map                                        // 连接存储，方便关闭已经连接的连接
 	closed atomicBool                                      // 关闭
 	used   atomicBool                                      // 正在使用
+	rate   rateScope                                       // 带宽限制
 }
 
 // ConnNum 当前正在转发的连接数量
@@ -64,19 +66,19 @@ func (T *L2LSwap) Swap() error {
 		conna, err := T.ll.aGetConn()
 		if err != nil {
 			atomic.AddInt32(&T.ll.currUseConn, -1)
-			// T.ll.logf("%s 池中读取连接错误: %s", T.ll.alisten.Addr().String(), err)
+			// T.ll.log().debug("池中读取连接错误", "local", T.ll.alisten.Addr(), "error", err)
 			continue
 		}
 
 		atomic.AddInt32(&T.ll.currUseConn, 1)
 		connb, err := T.ll.bGetConn()
 		if err != nil {
-			// T.ll.logf("%s 池中读取连接错误: %s", T.ll.blisten.Addr().String(), err)
+			// T.ll.log().debug("池中读取连接错误", "local", T.ll.blisten.Addr(), "error", err)
 			atomic.AddInt32(&T.ll.currUseConn, -2)
 			// 重新进池
 			err = T.ll.acp.Put(conna, T.ll.alisten.Addr())
 			if err != nil {
-				// T.ll.logf("%s 连接加入 %s 池中读取连接错误: %s", conna.RemoteAddr().String(), conna.LocalAddr().String(), err)
+				// T.ll.log().debug("连接加入池中错误", "local", conna.LocalAddr(), "remote", conna.RemoteAddr(), "error", err)
 				conna.Close()
 			}
 			continue
@@ -94,9 +96,18 @@ func (T *L2LSwap) dataCopy(conna, connb net.Conn) {
 
 	defer atomic.AddInt32(&T.ll.currUseConn, -2)
 
+	// 配对之后结束都通知 OnClose
+	var (
+		s   = T.ll.Hooks.pair(conna.RemoteAddr(), connb.RemoteAddr(), true)
+		n   [2]int64
+		err error
+	)
+	defer func() { T.ll.Hooks.close(s, n, err) }()
+
 	if T.closed.isTrue() {
 		conna.Close()
 		connb.Close()
+		err = errSwapClosed
 		return
 	}
 
@@ -104,22 +115,52 @@ func (T *L2LSwap) dataCopy(conna, connb net.Conn) {
 	T.conns.Set(conna, connb)
 	defer T.conns.Del(conna)
 
+	lg := T.ll.log().with("conn", nextConnID(), "a", conna.RemoteAddr(), "b", connb.RemoteAddr())
+
+	// 向B方发送PROXY协议头，携带A方客户端地址
+	if T.ll.ProxyProtocol != 0 {
+		if err = writeProxyHeader(connb, T.ll.ProxyProtocol, conna.RemoteAddr(), conna.LocalAddr()); err != nil {
+			lg.warn("发送PROXY协议头失败", "error", err)
+			atomic.AddInt64(&T.ll.stats.failed, 1)
+			conna.Close()
+			connb.Close()
+			return
+		}
+	}
+
 	//----------------------------
-	var err error
 	if T.Verify != nil {
 		conna, connb, err = T.Verify(conna, connb)
 		if err != nil {
-			T.ll.logf("验证失败: %s", err)
+			lg.warn("验证失败", "error", err)
+			atomic.AddInt64(&T.ll.stats.verifyFailed, 1)
 			return
 		}
 	}
 
-	go func() {
-		copyData(conna, connb, bufSize)
-		conna.Close()
-	}()
-	copyData(connb, conna, bufSize)
-	connb.Close()
+	// 带宽限制
+	if rate := T.ll.RateLimit.acquire(conna.RemoteAddr(), &T.rate); rate != nil {
+		defer rate.release()
+		conna, connb = newRateConn(conna, rate, dirUp), newRateConn(connb, rate, dirDown)
+	}
+
+	start := time.Now()
+	n, err = swapData(conna, connb, bufSize, T.ll.HalfCloseTimeout, &T.ll.stats.bytes)
+	atomic.AddInt64(&T.ll.stats.completed, 1)
+	lg.closed(n, start, err)
+}
+
+// Stats 统计快照，可以在其它协程中调用
+//
+//	Stats       统计
+func (T *L2LSwap) Stats() Stats {
+	s := T.ll.stats.snapshot(T.ConnNum())
+	aaddr, baddr := T.ll.alisten.Addr(), T.ll.blisten.Addr()
+	s.Idle = []int{
+		T.ll.acp.ConnNumIde(aaddr.Network(), aaddr.String()),
+		T.ll.bcp.ConnNumIde(baddr.Network(), baddr.String()),
+	}
+	return s
 }
 
 func (T *L2LSwap) Close() error {
@@ -138,8 +179,17 @@ func (T *L2LSwap) Close() error {
 	return nil
 }
 
+// L2L一方监听的设置
+type l2lSide struct {
+	verify func(net.Conn) bool
+	acl    *ACL         // 访问控制
+	proxy  *ProxyAccept // 接收PROXY协议头
+	tls    *tls.Config  // TLS解密
+	id     *IdentityMap // 客户端证书身份映射
+}
+
 // L2L 是在公网主机上面监听两个TCP端口，由两个内网客户端连接。 L2L使这两个连接进行交换数据，达成内网到内网通道。
-// 注意：1）双方必须主动连接公网L2L。2）不支持UDP协议。
+// 注意：1）双方必须主动连接公网L2L。2）不支持UDP协议，UDP可以由 L2D.UDPOverTCP 或 D2D.UDPOverTCP 按帧通过TCP转发。
 //
 //		------------------------------------
 //	 |     |  →  |   |  ←  |     |（1，A和B同时连接[D2D]，由[D2D]互相桥接A和B这两个连接）
@@ -147,18 +197,27 @@ func (T *L2LSwap) Close() error {
 //	 |     |  →  |   |  →  |     |（3，A 往 B 发送数据）
 //		------------------------------------
 type L2L struct {
-	ReadBufSize int         // 交换数据缓冲大小
-	ErrorLog    *log.Logger // 日志
+	ReadBufSize      int           // 交换数据缓冲大小
+	HalfCloseTimeout time.Duration // 一方结束后半关闭另一方，等待另一方向结束的时间，超时关闭双方。小于0 不半关闭，一方结束即关闭双方（默认：30s）
+	ErrorLog         *log.Logger   // 日志，没有设置 Logger 时使用，输出信息及以上级别
+	Logger           Logger        // 分级的结构化日志（默认：nil，使用 ErrorLog）
+	Name             string        // 规则名称，日志中的 rule 字段
+	Limit            *ConnLimit    // 连接限制，A，B双方共用（默认：nil，不限制）
+	RateLimit        *RateLimit    // 带宽限制，A，B双方共用（默认：nil，不限制）
+	Hooks            *Hooks        // 连接生命周期的回调（默认：nil，不回调）
+	ProxyProtocol    int           // 配对后向B方发送PROXY协议头，携带A方客户端地址。ProxyProtocolV1 或 ProxyProtocolV2（默认：0，不发送）
+	RUDP             *RUDPConfig   // 网络类型为 rudp, rudp4, rudp6 时的可靠UDP设置（默认：nil，使用默认设置）
 
 	alisten net.Listener       // A监听
 	acp     vconnpool.ConnPool // A方连接池
-	averify func(net.Conn) bool
+	aside   l2lSide            // A方设置
 
 	blisten net.Listener       // B监听
 	bcp     vconnpool.ConnPool // B方连接池
-	bverify func(net.Conn) bool
+	bside   l2lSide            // B方设置
 
-	currUseConn int32 // 当前使用连接数量
+	currUseConn int32      // 当前使用连接数量
+	stats       *swapStats // 统计
 
 	closed atomicBool // 关闭
 	used   atomicBool // 正在使用
@@ -213,7 +272,7 @@ func (T *L2L) bGetConn() (net.Conn, error) {
 	return T.bcp.Get(T.blisten.Addr())
 }
 
-func (T *L2L) bufConn(l net.Listener, cp *vconnpool.ConnPool, verify *func(net.Conn) bool) error {
+func (T *L2L) bufConn(l net.Listener, cp *vconnpool.ConnPool, side *l2lSide) error {
 	var tempDelay time.Duration
 	var ok bool
 	for {
@@ -222,37 +281,104 @@ func (T *L2L) bufConn(l net.Listener, cp *vconnpool.ConnPool, verify *func(net.C
 			if tempDelay, ok = temporaryError(err, tempDelay, time.Second); ok {
 				continue
 			}
-			T.logf("监听地址 %s， 并等待连接过程中失败: %v", l.Addr(), err)
+			T.log().error("等待连接失败", "local", l.Addr(), "error", err)
 			return err
 		}
 		tempDelay = 0
 
-		go T.examineConn(conn, l.Addr(), verify, cp)
+		go T.examineConn(conn, l.Addr(), side, cp)
 	}
 }
 
-func (T *L2L) examineConn(conn net.Conn, addr net.Addr, verify *func(net.Conn) bool, cp *vconnpool.ConnPool) {
+func (T *L2L) examineConn(conn net.Conn, addr net.Addr, side *l2lSide, cp *vconnpool.ConnPool) {
+	// 读取PROXY协议头，之后使用协议头中的客户端地址
+	if side.proxy != nil {
+		pconn, err := side.proxy.accept(conn)
+		if err != nil {
+			T.log().warn("读取PROXY协议头失败", "local", conn.LocalAddr(), "remote", conn.RemoteAddr(), "error", err)
+			atomic.AddInt64(&T.stats.rejected, 1)
+			conn.Close()
+			return
+		}
+		conn = pconn
+	}
+
+	lg := T.log().with("local", conn.LocalAddr(), "remote", conn.RemoteAddr())
+
+	// 访问控制
+	if !side.acl.Permit(conn.RemoteAddr()) {
+		lg.warn("访问控制拒绝连接")
+		atomic.AddInt64(&T.stats.rejected, 1)
+		conn.Close()
+		return
+	}
+
 	// 连接最大限制，正在使用+池中空闲
 	if cp.MaxConn != 0 && T.currUseConns()+cp.ConnNum() >= cp.MaxConn {
-		// T.logf("%s 池中数量达到最大 %s 连接不能入池", conn.LocalAddr().String(), conn.RemoteAddr().String())
+		// lg.debug("池中数量达到最大，连接不能入池")
+		atomic.AddInt64(&T.stats.rejected, 1)
 		conn.Close()
 		return
 	}
 
-	if *verify != nil && !(*verify)(conn) {
-		T.logf("%s 连接验证失败", conn.RemoteAddr().String())
+	// 连接限制，连接关闭时释放
+	release, err := T.Limit.acquire(conn.RemoteAddr())
+	if err != nil {
+		T.Limit.logReject(lg, err)
+		atomic.AddInt64(&T.stats.rejected, 1)
 		conn.Close()
 		return
 	}
+	conn = &limitConn{Conn: conn, release: release}
+
+	// 通过访问控制和连接限制，加入池中之前结束都通知 OnClose，加入池中之后由配对的交换通知
+	atomic.AddInt64(&T.stats.accepted, 1)
+	T.Hooks.accept(addr, conn.RemoteAddr())
+	var s *Session
+	if side == &T.aside {
+		s = T.Hooks.pair(conn.RemoteAddr(), nil, false)
+	} else {
+		s = T.Hooks.pair(nil, conn.RemoteAddr(), false)
+	}
+	defer func() {
+		if err != nil {
+			T.Hooks.close(s, [2]int64{}, err)
+		}
+	}()
+
+	// TLS解密
+	if side.tls != nil {
+		var tconn net.Conn
+		if tconn, err = tlsServer(conn, side.tls); err != nil {
+			lg.warn("TLS握手失败", "error", err)
+			atomic.AddInt64(&T.stats.verifyFailed, 1)
+			conn.Close()
+			return
+		}
+		if conn, err = identify(tconn, side.id); err != nil {
+			lg.warn("身份验证失败", "error", err)
+			atomic.AddInt64(&T.stats.verifyFailed, 1)
+			tconn.Close()
+			return
+		}
+	}
 
-	if err := cp.Put(conn, addr); err != nil {
+	if side.verify != nil && !side.verify(conn) {
+		lg.warn("连接验证失败", "identity", ConnIdentity(conn))
+		atomic.AddInt64(&T.stats.verifyFailed, 1)
+		conn.Close()
+		err = errVerify
+		return
+	}
+
+	if err = cp.Put(conn, addr); err != nil {
 		// 池中受最大连接限制，无法加入池中。
-		// T.logf("%s 连接加入 %s 池中读取连接错误: %s", conn.RemoteAddr().String(), conn.LocalAddr().String(), err)
+		// lg.debug("连接加入池中错误", "error", err)
 		conn.Close()
 	}
 }
 
-// Transport 支持协议类型："tcp", "tcp4","tcp6", "unix" 或 "unixpacket".
+// Transport 支持协议类型："tcp", "tcp4","tcp6", "unix" 或 "unixpacket"，可靠UDP："rudp", "rudp4", "rudp6".
 //
 //	aaddr, baddr *Addr  A&B监听地址
 //	*L2LSwap    交换数据
@@ -262,32 +388,73 @@ func (T *L2L) Transport(aaddr, baddr *Addr) (*L2LSwap, error) {
 		return nil, errors.New("vforward: 不能重复调用 L2L.Transport")
 	}
 	T.init()
+	T.stats = new(swapStats)
 	var err error
-	T.alisten, err = reuseport.Listen(aaddr.Network, aaddr.Local.String())
+	T.alisten, err = T.listen(aaddr)
 	if err != nil {
-		T.logf("监听地址 %s 失败: %v", aaddr.Local.String(), err)
+		T.log().error("监听失败", "local", aaddr.Local, "error", err)
 		return nil, err
 	}
-	T.blisten, err = reuseport.Listen(baddr.Network, baddr.Local.String())
+	T.blisten, err = T.listen(baddr)
 	if err != nil {
 		T.alisten.Close()
 		T.alisten = nil
-		T.logf("监听地址 %s 失败: %v", baddr.Local.String(), err)
+		T.log().error("监听失败", "local", baddr.Local, "error", err)
 		return nil, err
 	}
-	go T.bufConn(T.alisten, &T.acp, &T.averify)
-	go T.bufConn(T.blisten, &T.bcp, &T.bverify)
+	go T.bufConn(T.alisten, &T.acp, &T.aside)
+	go T.bufConn(T.blisten, &T.bcp, &T.bside)
 
 	return &L2LSwap{ll: T}, nil
 }
 
+func (T *L2L) listen(addr *Addr) (net.Listener, error) {
+	if isRUDP(addr.Network) {
+		return ListenRUDP(addr.Network, addr.Local.String(), T.RUDP)
+	}
+	return reuseport.Listen(addr.Network, addr.Local.String())
+}
+
 // Verify 连接第一时间完成，即验证可用后才送入池中。
 //
 // a func(net.Conn) error	验证
 // b func(net.Conn) error	验证
 func (T *L2L) Verify(a func(net.Conn) bool, b func(net.Conn) bool) {
-	T.averify = a
-	T.bverify = b
+	T.aside.verify = a
+	T.bside.verify = b
+}
+
+// ACL 访问控制，连接第一时间检查，拒绝的连接不会进入验证。
+//
+//	a, b *ACL	A，B方访问控制，nil 全部允许
+func (T *L2L) ACL(a, b *ACL) {
+	T.aside.acl = a
+	T.bside.acl = b
+}
+
+// ProxyAccept 接收PROXY协议头，之后访问控制，验证和日志使用协议头中的客户端地址。
+//
+//	a, b *ProxyAccept	A，B方接收设置，nil 不接收
+func (T *L2L) ProxyAccept(a, b *ProxyAccept) {
+	T.aside.proxy = a
+	T.bside.proxy = b
+}
+
+// TLSConfig 监听使用TLS，连接解密后再进行交换。
+//
+//	a, b *tls.Config	A，B方TLS设置，nil 不加密
+func (T *L2L) TLSConfig(a, b *tls.Config) {
+	T.aside.tls = a
+	T.bside.tls = b
+}
+
+// Identity 客户端证书身份映射，没有对应身份的证书被拒绝，需要 TLSConfig 要求客户端证书。
+// 身份可以在 Verify 中通过 ConnIdentity 读取。
+//
+//	a, b *IdentityMap	A，B方身份映射，nil 使用证书CN
+func (T *L2L) Identity(a, b *IdentityMap) {
+	T.aside.id = a
+	T.bside.id = b
 }
 
 // Close 关闭L2L
@@ -304,6 +471,6 @@ func (T *L2L) Close() error {
 	return nil
 }
 
-func (T *L2L) logf(format string, v ...interface{}) {
-	errLog(T.ErrorLog, format, v...)
+func (T *L2L) log() logger {
+	return newLogger(T.Logger, T.ErrorLog, T.Name)
 }
@@ -0,0 +1,238 @@
+package vforward
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errLimitIPConn = errors.New("vforward: 单个IP并发连接数量达到最大")
+	errLimitIPRate = errors.New("vforward: 单个IP新建连接速率超出限制")
+	errLimitRate   = errors.New("vforward: 新建连接速率超出限制")
+)
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	rate   float64 // 每秒产生令牌数量
+	burst  float64 // 桶容量
+	tokens float64 // 当前令牌数量
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// 按时间补充令牌，调用前需要加锁
+func (T *tokenBucket) refill(now time.Time) {
+	T.tokens = math.Min(T.burst, T.tokens+now.Sub(T.last).Seconds()*T.rate)
+	T.last = now
+}
+
+// allow 取出n个令牌，不足返回false
+func (T *tokenBucket) allow(n float64) bool {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.refill(time.Now())
+	if T.tokens < n {
+		return false
+	}
+	T.tokens -= n
+	return true
+}
+
+// refund 退回n个令牌
+func (T *tokenBucket) refund(n float64) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.tokens = math.Min(T.burst, T.tokens+n)
+}
+
+// setRate 修改速率，桶容量为1秒的令牌数量，调用前需要加锁
+func (T *tokenBucket) setRate(rate float64) {
+	if T.rate == rate {
+		return
+	}
+	burst := math.Max(1, math.Ceil(rate))
+	if T.rate == 0 {
+		// 第一次使用，桶是满的
+		T.tokens = burst
+	}
+	T.rate, T.burst = rate, burst
+	T.tokens = math.Min(T.tokens, burst)
+}
+
+// reserve 以 rate 速率取出n个令牌，不足时预支，返回需要等待的时间
+func (T *tokenBucket) reserve(n, rate float64) time.Duration {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.refill(time.Now())
+	T.setRate(rate)
+	T.tokens -= n
+	if T.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-T.tokens / rate * float64(time.Second))
+}
+
+// take 以 rate 速率取出n个令牌，不足返回false。桶满时允许预支，n 可以大于桶容量
+func (T *tokenBucket) take(n, rate float64) bool {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.refill(time.Now())
+	T.setRate(rate)
+	if T.tokens < n && T.tokens < T.burst {
+		return false
+	}
+	T.tokens -= n
+	return true
+}
+
+// full 令牌桶已满，即长时间没有使用
+func (T *tokenBucket) full() bool {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.refill(time.Now())
+	return T.tokens >= T.burst
+}
+
+type ipLimit struct {
+	conns  int          // 并发连接数量
+	bucket *tokenBucket // 新建连接速率
+}
+
+// ConnLimit 连接限制，限制单个IP并发连接数量，单个IP和全局的新建连接速率。
+type ConnLimit struct {
+	PerIPConn  int     // 单个IP并发连接数量（默认：0，不限制）
+	PerIPRate  float64 // 单个IP每秒新建连接数量（默认：0，不限制）
+	PerIPBurst int     // 单个IP新建连接突发数量（默认：PerIPRate 向上取整）
+	Rate       float64 // 全局每秒新建连接数量（默认：0，不限制）
+	Burst      int     // 全局新建连接突发数量（默认：Rate 向上取整）
+
+	ips      map[string]*ipLimit
+	global   *tokenBucket
+	sweep    time.Time // 上次清理时间
+	mu       sync.Mutex
+	rejected int64 // 拒绝数量
+
+	logLast    time.Time // 上次日志时间
+	logSkipped int64     // 未输出日志的拒绝数量
+	logMu      sync.Mutex
+}
+
+// Rejected 被拒绝的连接数量
+//
+//	int64   数量
+func (T *ConnLimit) Rejected() int64 {
+	return atomic.LoadInt64(&T.rejected)
+}
+
+// acquire 占用一个连接，使用完需要调用返回的函数释放。ConnLimit为nil时不限制
+//
+//	addr net.Addr   来源地址
+//	func()          释放
+//	error           拒绝原因
+func (T *ConnLimit) acquire(addr net.Addr) (func(), error) {
+	if T == nil {
+		return func() {}, nil
+	}
+	host := addrHost(addr)
+
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	now := time.Now()
+	if T.ips == nil {
+		T.ips = make(map[string]*ipLimit)
+	}
+	if T.Rate > 0 && T.global == nil {
+		T.global = newTokenBucket(T.Rate, T.Burst)
+	}
+	if now.Sub(T.sweep) > time.Minute {
+		T.sweep = now
+		for k, v := range T.ips {
+			if v.conns == 0 && (v.bucket == nil || v.bucket.full()) {
+				delete(T.ips, k)
+			}
+		}
+	}
+
+	ipl := T.ips[host]
+	if ipl == nil {
+		ipl = new(ipLimit)
+		if T.PerIPRate > 0 {
+			ipl.bucket = newTokenBucket(T.PerIPRate, T.PerIPBurst)
+		}
+		T.ips[host] = ipl
+	}
+	if T.PerIPConn > 0 && ipl.conns >= T.PerIPConn {
+		atomic.AddInt64(&T.rejected, 1)
+		return nil, errLimitIPConn
+	}
+	if ipl.bucket != nil && !ipl.bucket.allow(1) {
+		atomic.AddInt64(&T.rejected, 1)
+		return nil, errLimitIPRate
+	}
+	if T.global != nil && !T.global.allow(1) {
+		// 连接没有建立，退回单个IP的令牌
+		if ipl.bucket != nil {
+			ipl.bucket.refund(1)
+		}
+		atomic.AddInt64(&T.rejected, 1)
+		return nil, errLimitRate
+	}
+
+	ipl.conns++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			T.mu.Lock()
+			defer T.mu.Unlock()
+			ipl.conns--
+			if ipl.conns == 0 && ipl.bucket == nil {
+				delete(T.ips, host)
+			}
+		})
+	}, nil
+}
+
+// logReject 输出拒绝日志，每秒最多一条，其它累计到下一条日志
+func (T *ConnLimit) logReject(lg logger, err error) {
+	T.logMu.Lock()
+	defer T.logMu.Unlock()
+	now := time.Now()
+	if now.Sub(T.logLast) < time.Second {
+		T.logSkipped++
+		return
+	}
+	T.logLast = now
+	if T.logSkipped > 0 {
+		lg.warn("连接被限制", "error", err, "skipped", T.logSkipped)
+		T.logSkipped = 0
+		return
+	}
+	lg.warn("连接被限制", "error", err)
+}
+
+// limitConn 关闭连接时释放占用
+type limitConn struct {
+	net.Conn
+	release func()
+}
+
+// RawConn 原连接
+func (T *limitConn) RawConn() net.Conn { return T.Conn }
+
+func (T *limitConn) Close() error {
+	T.release()
+	return T.Conn.Close()
+}
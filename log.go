@@ -0,0 +1,242 @@
+package vforward
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel 日志级别
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota // 调试，每个连接交换结束等
+	LevelInfo                  // 信息，远程恢复可用，故障转移等
+	LevelWarn                  // 警告，拒绝连接，验证失败，发起连接失败等
+	LevelError                 // 错误，监听失败，没有可用的远程等
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (T LogLevel) String() string {
+	if T >= LevelDebug && int(T) < len(levelNames) {
+		return levelNames[T]
+	}
+	return "level(" + strconv.Itoa(int(T)) + ")"
+}
+
+// ParseLogLevel 解析日志级别
+//
+//	s string        debug, info, warn, error
+//	LogLevel        级别
+//	error           错误
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, errors.New("vforward: 日志级别是未知的，可以是 debug, info, warn, error")
+}
+
+// Logger 分级的结构化日志
+type Logger interface {
+	// Log 输出一条日志，kv 为键值对，键是字符串。
+	// 常用的键：rule 规则名称，conn 连接编号，local 本地地址，remote 对端地址，target 发起连接的远程地址，
+	// a, b D2D和L2L双方的对端地址，bytes_in, bytes_out 上行，下行字节数，duration 时长，error 错误
+	Log(level LogLevel, msg string, kv ...interface{})
+}
+
+// stdLogger 使用 log.Logger 输出文本
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+// NewStdLogger 使用 log.Logger 输出文本日志，格式为 级别 消息 键=值 ...
+//
+//	l *log.Logger       日志，nil 使用 log 包的标准日志
+//	level LogLevel      最低输出级别
+//	Logger              日志
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+func (T *stdLogger) Log(level LogLevel, msg string, kv ...interface{}) {
+	T.output(3, level, msg, kv)
+}
+
+// output 输出日志，calldepth 同 log.Output，用于取得调用者的文件和行号
+func (T *stdLogger) output(calldepth int, level LogLevel, msg string, kv []interface{}) {
+	if level < T.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		var v interface{}
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		s := logValue(v)
+		if s == "" || strings.ContainsAny(s, " =\"\n") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+	if T.l != nil {
+		T.l.Output(calldepth, b.String())
+		return
+	}
+	log.Output(calldepth, b.String())
+}
+
+// jsonLogger 每行输出一个JSON对象
+type jsonLogger struct {
+	w     io.Writer
+	level LogLevel
+	mu    sync.Mutex
+}
+
+// NewJSONLogger 每行输出一个JSON对象，包含 time, level, msg 和键值对
+//
+//	w io.Writer         输出
+//	level LogLevel      最低输出级别
+//	Logger              日志
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &jsonLogger{w: w, level: level}
+}
+
+func (T *jsonLogger) Log(level LogLevel, msg string, kv ...interface{}) {
+	if level < T.level {
+		return
+	}
+	b := make([]byte, 0, 256)
+	b = append(b, `{"time":`...)
+	b = strconv.AppendQuote(b, time.Now().Format(time.RFC3339Nano))
+	b = append(b, `,"level":`...)
+	b = strconv.AppendQuote(b, level.String())
+	b = append(b, `,"msg":`...)
+	b = appendJSON(b, msg)
+	for i := 0; i < len(kv); i += 2 {
+		var v interface{}
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		b = append(b, ',')
+		b = appendJSON(b, fmt.Sprint(kv[i]))
+		b = append(b, ':')
+		switch v.(type) {
+		case nil, bool, int, int32, int64, uint, uint32, uint64, float64:
+			b = appendJSON(b, v)
+		default:
+			b = appendJSON(b, logValue(v))
+		}
+	}
+	b = append(b, "}\n"...)
+
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.w.Write(b)
+}
+
+func appendJSON(b []byte, v interface{}) []byte {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return strconv.AppendQuote(b, fmt.Sprint(v))
+	}
+	return append(b, p...)
+}
+
+// logValue 值的文本
+func logValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// 连接编号，日志中区分同一个连接的多条日志
+var connIDs uint64
+
+func nextConnID() uint64 {
+	return atomic.AddUint64(&connIDs, 1)
+}
+
+// depthLogger 可以指定调用层数的日志
+type depthLogger interface {
+	output(calldepth int, level LogLevel, msg string, kv []interface{})
+}
+
+// logger 带有固定键值对的日志
+type logger struct {
+	l  Logger
+	kv []interface{}
+}
+
+// newLogger 没有设置 Logger 时使用 errorLog 输出信息及以上级别
+//
+//	l Logger                日志
+//	errorLog *log.Logger    旧的日志设置
+//	name string             规则名称，不为空时加上 rule
+func newLogger(l Logger, errorLog *log.Logger, name string) logger {
+	if l == nil {
+		l = NewStdLogger(errorLog, LevelInfo)
+	}
+	lg := logger{l: l}
+	if name != "" {
+		lg.kv = []interface{}{"rule", name}
+	}
+	return lg
+}
+
+// with 加上固定的键值对
+func (T logger) with(kv ...interface{}) logger {
+	all := make([]interface{}, 0, len(T.kv)+len(kv))
+	return logger{l: T.l, kv: append(append(all, T.kv...), kv...)}
+}
+
+// log 输出日志，depth 为调用者的层数，1 为 log 的调用者，2 为再上一层
+func (T logger) log(depth int, level LogLevel, msg string, kv []interface{}) {
+	if len(T.kv) > 0 {
+		kv = append(T.kv[:len(T.kv):len(T.kv)], kv...)
+	}
+	if dl, ok := T.l.(depthLogger); ok {
+		dl.output(depth+2, level, msg, kv)
+		return
+	}
+	T.l.Log(level, msg, kv...)
+}
+
+func (T logger) debug(msg string, kv ...interface{}) { T.log(2, LevelDebug, msg, kv) }
+func (T logger) info(msg string, kv ...interface{})  { T.log(2, LevelInfo, msg, kv) }
+func (T logger) warn(msg string, kv ...interface{})  { T.log(2, LevelWarn, msg, kv) }
+func (T logger) error(msg string, kv ...interface{}) { T.log(2, LevelError, msg, kv) }
+
+// closed 交换结束的调试日志
+func (T logger) closed(n [2]int64, start time.Time, err error) {
+	kv := []interface{}{"bytes_in", n[dirUp], "bytes_out", n[dirDown], "duration", time.Since(start)}
+	if err != nil {
+		kv = append(kv, "error", err)
+	}
+	T.log(2, LevelDebug, "交换结束", kv)
+}
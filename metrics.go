@@ -0,0 +1,130 @@
+package vforward
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsContentType Prometheus 文本格式的内容类型
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsEscaper 标签值的转义
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metric 一个指标
+type metric struct {
+	name string
+	help string
+	typ  string
+	// 写入一个规则的样本，label 为已格式化的 rule 标签
+	write func(mw *metricsWriter, label string, s *Stats)
+}
+
+var metrics = []metric{
+	{"vforward_connections", "当前正在转发的连接数量", "gauge", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_connections", label, "", float64(s.Conns))
+	}},
+	{"vforward_pool_idle_connections", "D2D和L2L池中的空闲连接数量", "gauge", func(mw *metricsWriter, label string, s *Stats) {
+		for i, side := range [...]string{"a", "b"} {
+			if i < len(s.Idle) {
+				mw.sample("vforward_pool_idle_connections", label, `side="`+side+`"`, float64(s.Idle[i]))
+			}
+		}
+	}},
+	{"vforward_bytes_total", "转发的字节数，in 为上行，out 为下行", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_bytes_total", label, `direction="in"`, float64(s.BytesIn))
+		mw.sample("vforward_bytes_total", label, `direction="out"`, float64(s.BytesOut))
+	}},
+	{"vforward_packets_total", "转发的UDP数据报数量，in 为上行，out 为下行", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_packets_total", label, `direction="in"`, float64(s.PacketsIn))
+		mw.sample("vforward_packets_total", label, `direction="out"`, float64(s.PacketsOut))
+	}},
+	{"vforward_connections_accepted_total", "通过访问控制和连接限制的连接数量，不含被拒绝的连接", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_connections_accepted_total", label, "", float64(s.Accepted))
+	}},
+	{"vforward_connections_rejected_total", "被拒绝的连接数量", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_connections_rejected_total", label, "", float64(s.Rejected))
+	}},
+	{"vforward_connections_failed_total", "失败的连接数量", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_connections_failed_total", label, "", float64(s.Failed))
+	}},
+	{"vforward_connections_completed_total", "交换完成的连接数量", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_connections_completed_total", label, "", float64(s.Completed))
+	}},
+	{"vforward_verify_failed_total", "验证失败的连接数量", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		mw.sample("vforward_verify_failed_total", label, "", float64(s.VerifyFailed))
+	}},
+	{"vforward_dial_errors_total", "发起连接失败的数量", "counter", func(mw *metricsWriter, label string, s *Stats) {
+		for i, reason := range DialErrorReasons {
+			mw.sample("vforward_dial_errors_total", label, `reason="`+reason+`"`, float64(s.DialErrors[i]))
+		}
+	}},
+	{"vforward_dial_latency_seconds", "发起连接的耗时", "histogram", func(mw *metricsWriter, label string, s *Stats) {
+		for i, le := range DialLatencyBuckets {
+			mw.sample("vforward_dial_latency_seconds_bucket", label, `le="`+formatFloat(le.Seconds())+`"`, float64(s.DialHistogram[i]))
+		}
+		mw.sample("vforward_dial_latency_seconds_bucket", label, `le="+Inf"`, float64(s.Dials))
+		mw.sample("vforward_dial_latency_seconds_sum", label, "", s.DialLatencySum.Seconds())
+		mw.sample("vforward_dial_latency_seconds_count", label, "", float64(s.Dials))
+	}},
+}
+
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (T *metricsWriter) sample(name, label, extra string, v float64) {
+	T.w.WriteString(name)
+	T.w.WriteString("{")
+	T.w.WriteString(label)
+	if extra != "" {
+		T.w.WriteString(",")
+		T.w.WriteString(extra)
+	}
+	T.w.WriteString("} ")
+	T.w.WriteString(formatFloat(v))
+	T.w.WriteString("\n")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteMetrics 以 Prometheus 文本格式写入统计，每个规则使用 rule 标签区分
+//
+//	w io.Writer                 写入
+//	rules map[string]Stats      规则名称和统计
+//	error                       错误
+func WriteMetrics(w io.Writer, rules map[string]Stats) error {
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		mw.w.WriteString("# HELP " + m.name + " " + m.help + "\n")
+		mw.w.WriteString("# TYPE " + m.name + " " + m.typ + "\n")
+		for _, name := range names {
+			s := rules[name]
+			m.write(mw, `rule="`+metricsEscaper.Replace(name)+`"`, &s)
+		}
+	}
+	return mw.w.Flush()
+}
+
+// MetricsHandler 返回指标的HTTP处理器，每次请求时调用 stats 取得全部规则的统计
+//
+//	stats func() map[string]Stats   规则名称和统计
+//	http.Handler                    处理器
+func MetricsHandler(stats func() map[string]Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MetricsContentType)
+		WriteMetrics(w, stats())
+	})
+}
@@ -0,0 +1,258 @@
+package vforward
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// 协议识别读取的最大长度
+const muxMaxPeek = 4096
+
+// 匹配结果
+const (
+	muxNo   = iota // 不匹配
+	muxYes         // 匹配
+	muxMore        // 需要更多数据
+)
+
+type muxRule struct {
+	match func(b []byte) int
+	rs    *Remotes
+}
+
+// MuxRouter 按连接最先发送的数据识别协议选择远程，多个协议共用一个端口。
+// 按添加顺序匹配，第一个匹配的规则决定远程。客户端在 Timeout 内没有发送数据时使用 OnTimeout，
+// 用于服务端先发送数据的协议。
+type MuxRouter struct {
+	Timeout   time.Duration // 读取首部数据超时（默认：2s）
+	OnTimeout *Remotes      // 客户端没有发送数据时的远程（默认：nil，使用 Default）
+	Default   *Remotes      // 没有匹配时的远程（默认：nil，使用 Transport 的远程）
+
+	rules []muxRule
+	mu    sync.RWMutex
+}
+
+// 内置协议
+var muxProtocols = map[string]func(b []byte) int{
+	"ssh":     muxPrefix([]byte("SSH-")),
+	"tls":     muxTLS,
+	"http":    muxHTTP,
+	"socks5":  muxSOCKS5,
+	"openvpn": muxOpenVPN,
+}
+
+// Add 添加内置协议的路由
+//
+//	protocol string     协议：ssh, tls, http, socks5, openvpn
+//	rs *Remotes         远程
+//	error               错误
+func (T *MuxRouter) Add(protocol string, rs *Remotes) error {
+	match, ok := muxProtocols[protocol]
+	if !ok {
+		return fmt.Errorf("vforward: 协议 %q 是未知的", protocol)
+	}
+	T.add(muxRule{match: match, rs: rs})
+	return nil
+}
+
+// AddPrefix 添加前缀匹配的路由
+//
+//	prefix []byte   连接最先发送的数据前缀
+//	rs *Remotes     远程
+func (T *MuxRouter) AddPrefix(prefix []byte, rs *Remotes) {
+	T.add(muxRule{match: muxPrefix(prefix), rs: rs})
+}
+
+// AddRegexp 添加正则匹配的路由，只匹配已经收到的数据，不等待更多数据
+//
+//	re *regexp.Regexp   正则，建议以 ^ 开头
+//	rs *Remotes         远程
+func (T *MuxRouter) AddRegexp(re *regexp.Regexp, rs *Remotes) {
+	T.add(muxRule{match: func(b []byte) int {
+		if re.Match(b) {
+			return muxYes
+		}
+		return muxNo
+	}, rs: rs})
+}
+
+func (T *MuxRouter) add(rule muxRule) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.rules = append(T.rules, rule)
+}
+
+// Remotes 路由中的全部远程
+//
+//	[]*Remotes  远程
+func (T *MuxRouter) Remotes() []*Remotes {
+	T.mu.RLock()
+	defer T.mu.RUnlock()
+	var rss []*Remotes
+	for _, rule := range T.rules {
+		rss = append(rss, rule.rs)
+	}
+	for _, rs := range []*Remotes{T.OnTimeout, T.Default} {
+		if rs != nil {
+			rss = append(rss, rs)
+		}
+	}
+	return rss
+}
+
+// Route 选择远程，见 Router
+func (T *MuxRouter) Route(conn net.Conn) (net.Conn, *Remotes, error) {
+	timeout := T.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+	pc := newPeekConn(conn, muxMaxPeek)
+	rs, err := T.sniff(pc.r)
+	if err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, nil, err
+		}
+		if pc.r.Buffered() == 0 {
+			// 客户端没有发送数据
+			rs = T.OnTimeout
+		}
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	if rs == nil {
+		rs = T.Default
+	}
+	return pc, rs, nil
+}
+
+// sniff 读取数据直到有规则匹配，或全部规则不匹配
+func (T *MuxRouter) sniff(r *bufio.Reader) (*Remotes, error) {
+	for n := 1; ; n = r.Buffered() + 1 {
+		if _, err := r.Peek(n); err != nil {
+			return nil, err
+		}
+		b, _ := r.Peek(r.Buffered())
+
+		T.mu.RLock()
+		var more bool
+		for _, rule := range T.rules {
+			switch rule.match(b) {
+			case muxYes:
+				T.mu.RUnlock()
+				return rule.rs, nil
+			case muxMore:
+				more = true
+			}
+		}
+		T.mu.RUnlock()
+		if !more || len(b) >= muxMaxPeek {
+			return nil, nil
+		}
+	}
+}
+
+// 前缀匹配
+func muxPrefix(prefix []byte) func(b []byte) int {
+	return func(b []byte) int {
+		if len(b) >= len(prefix) {
+			if bytes.HasPrefix(b, prefix) {
+				return muxYes
+			}
+			return muxNo
+		}
+		if bytes.HasPrefix(prefix, b) {
+			return muxMore
+		}
+		return muxNo
+	}
+}
+
+// TLS记录：类型 handshake，版本 3.x
+func muxTLS(b []byte) int {
+	switch {
+	case len(b) >= 3:
+		if b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x04 {
+			return muxYes
+		}
+		return muxNo
+	case len(b) == 2 && (b[0] != 0x16 || b[1] != 0x03):
+		return muxNo
+	case b[0] != 0x16:
+		return muxNo
+	}
+	return muxMore
+}
+
+// HTTP请求方法
+var muxHTTPMethods = []func(b []byte) int{
+	muxPrefix([]byte("GET ")),
+	muxPrefix([]byte("POST ")),
+	muxPrefix([]byte("PUT ")),
+	muxPrefix([]byte("HEAD ")),
+	muxPrefix([]byte("DELETE ")),
+	muxPrefix([]byte("OPTIONS ")),
+	muxPrefix([]byte("PATCH ")),
+	muxPrefix([]byte("CONNECT ")),
+	muxPrefix([]byte("TRACE ")),
+	muxPrefix([]byte("PRI * HTTP/2")),
+}
+
+func muxHTTP(b []byte) int {
+	result := muxNo
+	for _, method := range muxHTTPMethods {
+		switch method(b) {
+		case muxYes:
+			return muxYes
+		case muxMore:
+			result = muxMore
+		}
+	}
+	return result
+}
+
+// SOCKS5问候：版本5，方法数量，方法列表
+func muxSOCKS5(b []byte) int {
+	switch {
+	case b[0] != 0x05:
+		return muxNo
+	case len(b) < 2:
+		return muxMore
+	case b[1] == 0:
+		return muxNo
+	case len(b) < 2+int(b[1]):
+		return muxMore
+	case len(b) == 2+int(b[1]):
+		return muxYes
+	}
+	return muxNo
+}
+
+// OpenVPN TCP：长度，操作码 P_CONTROL_HARD_RESET_CLIENT_V2 或 V3
+func muxOpenVPN(b []byte) int {
+	if b[0] > 0x04 {
+		return muxNo
+	}
+	if len(b) < 2 {
+		return muxMore
+	}
+	size := int(b[0])<<8 | int(b[1])
+	if size < 14 || size > 1024 {
+		return muxNo
+	}
+	if len(b) < 3 {
+		return muxMore
+	}
+	if op := b[2] >> 3; op == 7 || op == 10 {
+		return muxYes
+	}
+	return muxNo
+}
@@ -0,0 +1,272 @@
+package vforward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY协议版本
+const (
+	ProxyProtocolV1 = 1 // 文本格式，仅支持TCP
+	ProxyProtocolV2 = 2 // 二进制格式，支持TCP和UDP
+)
+
+// PROXY协议v2签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader 生成PROXY协议头，地址不是IP地址时生成 UNKNOWN(v1) 或 LOCAL(v2) 头
+//
+//	version int         版本
+//	src, dst net.Addr   客户端地址，客户端连接的本地地址
+//	[]byte              协议头
+//	error               错误
+func proxyHeader(version int, src, dst net.Addr) ([]byte, error) {
+	srcIP, srcPort, srcUDP := proxyAddr(src)
+	dstIP, dstPort, _ := proxyAddr(dst)
+	ipv4 := srcIP.To4() != nil && dstIP.To4() != nil
+	switch version {
+	case ProxyProtocolV1:
+		if srcIP == nil || dstIP == nil {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		if srcUDP {
+			return nil, errors.New("vforward: PROXY协议v1不支持UDP")
+		}
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP.To4(), dstIP.To4(), srcPort, dstPort)), nil
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcIP.To16(), dstIP.To16(), srcPort, dstPort)), nil
+	case ProxyProtocolV2:
+		b := append([]byte{}, proxyV2Sig...)
+		if srcIP == nil || dstIP == nil {
+			// LOCAL 命令，没有地址
+			return append(b, 0x20, 0x00, 0x00, 0x00), nil
+		}
+		var fam byte = 0x11 // TCP over IPv4
+		if !ipv4 {
+			fam = 0x21 // TCP over IPv6
+		}
+		if srcUDP {
+			fam++ // UDP
+		}
+		b = append(b, 0x21, fam)
+		var addrs []byte
+		if ipv4 {
+			addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+		} else {
+			addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+		}
+		var port [4]byte
+		binary.BigEndian.PutUint16(port[0:], uint16(srcPort))
+		binary.BigEndian.PutUint16(port[2:], uint16(dstPort))
+		addrs = append(addrs, port[:]...)
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(addrs)))
+		b = append(b, size[:]...)
+		return append(b, addrs...), nil
+	}
+	return nil, fmt.Errorf("vforward: PROXY协议版本 %d 是未知的", version)
+}
+
+// 地址的IP，端口，是否UDP
+func proxyAddr(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}
+
+// writeProxyHeader 向连接写入PROXY协议头
+func writeProxyHeader(conn net.Conn, version int, src, dst net.Addr) error {
+	b, err := proxyHeader(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// ProxyAccept 监听接收PROXY协议头，连接的 RemoteAddr() 和 LocalAddr() 返回协议头中的客户端地址。
+// 没有发送协议头的连接按原样转发，协议头读取超时视为没有发送。
+type ProxyAccept struct {
+	Timeout time.Duration // 读取协议头超时（默认：5s）
+	Trusted *ACL          // 信任来源，只解析这些来源发送的协议头，nil 或没有规则时不信任任何来源
+	Strict  bool          // 严格模式，拒绝非信任来源和没有发送协议头的连接
+}
+
+// accept 读取并去掉连接的PROXY协议头
+func (T *ProxyAccept) accept(conn net.Conn) (net.Conn, error) {
+	// 必须明确信任来源，否则任何客户端都可以伪造地址，绕过访问控制和限制
+	trusted := false
+	if T.Trusted != nil {
+		allow, ok := T.Trusted.match(addrIP(conn.RemoteAddr()))
+		trusted = allow && ok
+	}
+	if !trusted {
+		if T.Strict {
+			return nil, errors.New("vforward: 来源不在PROXY协议信任列表中")
+		}
+		return conn, nil
+	}
+
+	timeout := T.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+	found, err := pc.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if !found && T.Strict {
+		return nil, errors.New("vforward: 没有发送PROXY协议头")
+	}
+	return pc, nil
+}
+
+// proxyConn 去掉PROXY协议头的连接
+type proxyConn struct {
+	net.Conn
+	r        *bufio.Reader
+	src, dst net.Addr // 协议头中的地址
+}
+
+// RawConn 原连接
+func (T *proxyConn) RawConn() net.Conn { return T.Conn }
+
+func (T *proxyConn) Read(b []byte) (int, error) {
+	return T.r.Read(b)
+}
+
+func (T *proxyConn) RemoteAddr() net.Addr {
+	if T.src != nil {
+		return T.src
+	}
+	return T.Conn.RemoteAddr()
+}
+
+func (T *proxyConn) LocalAddr() net.Addr {
+	if T.dst != nil {
+		return T.dst
+	}
+	return T.Conn.LocalAddr()
+}
+
+// readHeader 读取协议头，没有协议头返回false
+func (T *proxyConn) readHeader() (bool, error) {
+	b, err := T.r.Peek(1)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// 客户端没有发送数据，可能是服务端先发送数据的协议
+			return false, nil
+		}
+		return false, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, err = T.r.Peek(6); err != nil || string(b) != "PROXY " {
+			return false, nil
+		}
+		return true, T.readV1()
+	case '\r':
+		if b, err = T.r.Peek(len(proxyV2Sig)); err != nil || !bytes.Equal(b, proxyV2Sig) {
+			return false, nil
+		}
+		return true, T.readV2()
+	}
+	return false, nil
+}
+
+func (T *proxyConn) readV1() error {
+	// 协议头最大长度107字节
+	var line []byte
+	for len(line) < 107 {
+		b, err := T.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("vforward: PROXY协议头格式错误")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("vforward: PROXY协议头格式错误")
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return errors.New("vforward: PROXY协议头地址错误")
+	}
+	T.src = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	T.dst = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+func (T *proxyConn) readV2() error {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(T.r, head); err != nil {
+		return err
+	}
+	if head[12]>>4 != 2 {
+		return errors.New("vforward: PROXY协议头版本错误")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(T.r, body); err != nil {
+		return err
+	}
+	if head[12]&0x0F == 0x00 {
+		// LOCAL 命令，使用连接的地址
+		return nil
+	}
+	var ipLen int
+	switch head[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// UNSPEC 或 UNIX，使用连接的地址
+		return nil
+	}
+	if len(body) < ipLen*2+4 {
+		return errors.New("vforward: PROXY协议头地址错误")
+	}
+	srcIP := net.IP(append([]byte{}, body[:ipLen]...))
+	dstIP := net.IP(append([]byte{}, body[ipLen:ipLen*2]...))
+	srcPort := int(binary.BigEndian.Uint16(body[ipLen*2:]))
+	dstPort := int(binary.BigEndian.Uint16(body[ipLen*2+2:]))
+	if head[13]&0x0F == 0x2 {
+		T.src = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		T.dst = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		return nil
+	}
+	T.src = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	T.dst = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return nil
+}
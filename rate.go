@@ -0,0 +1,304 @@
+package vforward
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errRateFormat = errors.New("vforward: 速率格式错误，格式为 上行,下行，例如 1M,512K")
+
+// rateValue 可以在运行时修改的速率，0 不限制
+type rateValue uint64
+
+func (T *rateValue) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64((*uint64)(T)))
+}
+
+func (T *rateValue) store(v float64) {
+	if v < 0 {
+		v = 0
+	}
+	atomic.StoreUint64((*uint64)(T), math.Float64bits(v))
+}
+
+// rateScope 一级限制的上行和下行令牌桶
+type rateScope [2]tokenBucket
+
+// 进程内全部连接的带宽限制
+var processRate struct {
+	rate  [2]rateValue
+	scope rateScope
+}
+
+// SetProcessRate 设置进程内全部连接共用的带宽限制，在运行时修改立即生效。
+// 没有设置 RateLimit 的 L2D，D2D，L2L 只对设置之后的连接生效
+//
+//	up, down float64    上行，下行，单位：字节/秒，0 不限制
+func SetProcessRate(up, down float64) {
+	processRate.rate[dirUp].store(up)
+	processRate.rate[dirDown].store(down)
+}
+
+// ParseRate 解析速率，格式为 上行,下行，只有一个值时上行和下行相同。
+// 单位：字节/秒，可以加上 K, M, G（1024进制），例如 1M,512K
+//
+//	s string            速率
+//	up, down float64    上行，下行
+//	err error           错误
+func ParseRate(s string) (up, down float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) > 2 {
+		return 0, 0, errRateFormat
+	}
+	var rates [2]float64
+	for i, p := range parts {
+		p = strings.ToUpper(strings.TrimSpace(p))
+		p = strings.TrimSuffix(p, "B")
+		unit := 1.0
+		switch {
+		case strings.HasSuffix(p, "K"):
+			unit = 1 << 10
+		case strings.HasSuffix(p, "M"):
+			unit = 1 << 20
+		case strings.HasSuffix(p, "G"):
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			p = p[:len(p)-1]
+		}
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 {
+			return 0, 0, errRateFormat
+		}
+		rates[i] = v * unit
+	}
+	if len(parts) == 1 {
+		rates[dirDown] = rates[dirUp]
+	}
+	return rates[dirUp], rates[dirDown], nil
+}
+
+type ipRate struct {
+	scope rateScope
+	refs  int // 使用中的连接数量
+}
+
+// RateLimit 带宽限制，令牌桶实现，每个连接，每个来源IP，每个交换和进程（见 SetProcessRate）的限制同时生效。
+// 上行和下行分开限制，单位：字节/秒，0 不限制，在运行时修改立即生效。
+// TCP超过速率时等待，UDP超过速率时丢弃数据报。来源IP：L2D为客户端，D2D和L2L为A方
+type RateLimit struct {
+	conn    [2]rateValue
+	ip      [2]rateValue
+	swap    [2]rateValue
+	packets [2]rateValue
+
+	ips map[string]*ipRate
+	mu  sync.Mutex
+}
+
+// SetConn 设置每个连接的带宽，UDP为每个会话
+//
+//	up, down float64    上行，下行
+func (T *RateLimit) SetConn(up, down float64) {
+	T.conn[dirUp].store(up)
+	T.conn[dirDown].store(down)
+}
+
+// SetIP 设置每个来源IP的带宽，同一个IP的连接共用
+//
+//	up, down float64    上行，下行
+func (T *RateLimit) SetIP(up, down float64) {
+	T.ip[dirUp].store(up)
+	T.ip[dirDown].store(down)
+}
+
+// SetSwap 设置每个交换的带宽，同一个 Transport 返回的交换的连接共用
+//
+//	up, down float64    上行，下行
+func (T *RateLimit) SetSwap(up, down float64) {
+	T.swap[dirUp].store(up)
+	T.swap[dirDown].store(down)
+}
+
+// SetPackets 设置UDP每个会话每秒的数据报数量
+//
+//	up, down float64    上行，下行，单位：个/秒，0 不限制
+func (T *RateLimit) SetPackets(up, down float64) {
+	T.packets[dirUp].store(up)
+	T.packets[dirDown].store(down)
+}
+
+// acquire 取得连接的带宽限制，使用完需要调用 release。
+// RateLimit为nil并且没有设置进程限制时返回nil，不限制
+//
+//	addr net.Addr       来源地址
+//	swap *rateScope     交换的令牌桶
+//	*connRate           连接的带宽限制
+func (T *RateLimit) acquire(addr net.Addr, swap *rateScope) *connRate {
+	if T == nil {
+		if processRate.rate[dirUp].load() == 0 && processRate.rate[dirDown].load() == 0 {
+			return nil
+		}
+		return &connRate{}
+	}
+	host := addrHost(addr)
+
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	if T.ips == nil {
+		T.ips = make(map[string]*ipRate)
+	}
+	ip := T.ips[host]
+	if ip == nil {
+		ip = new(ipRate)
+		T.ips[host] = ip
+	}
+	ip.refs++
+	return &connRate{rl: T, host: host, ip: ip, swap: swap}
+}
+
+// connRate 一个连接的带宽限制
+type connRate struct {
+	rl      *RateLimit // 为nil时只有进程限制
+	host    string
+	conn    rateScope
+	packets rateScope
+	ip      *ipRate
+	swap    *rateScope
+	once    sync.Once
+}
+
+// release 释放来源IP的令牌桶
+func (T *connRate) release() {
+	if T.rl == nil {
+		return
+	}
+	T.once.Do(func() {
+		T.rl.mu.Lock()
+		defer T.rl.mu.Unlock()
+		T.ip.refs--
+		if T.ip.refs == 0 {
+			delete(T.rl.ips, T.host)
+		}
+	})
+}
+
+// each 依次调用每一级生效的限制
+func (T *connRate) each(dir int, f func(rate float64, b *tokenBucket) bool) bool {
+	check := func(v *rateValue, b *tokenBucket) bool {
+		if rate := v.load(); rate > 0 {
+			return f(rate, b)
+		}
+		return true
+	}
+	if T.rl != nil {
+		if !check(&T.rl.conn[dir], &T.conn[dir]) ||
+			!check(&T.rl.ip[dir], &T.ip.scope[dir]) ||
+			!check(&T.rl.swap[dir], &T.swap[dir]) {
+			return false
+		}
+	}
+	return check(&processRate.rate[dir], &processRate.scope[dir])
+}
+
+// chunk 每次读取的最大长度，约为最小速率的1/10秒，让速率平滑
+func (T *connRate) chunk(dir int, size int) int {
+	T.each(dir, func(rate float64, b *tokenBucket) bool {
+		if n := int(math.Max(1, rate/10)); n < size {
+			size = n
+		}
+		return true
+	})
+	return size
+}
+
+// reserve 取出n个字节的令牌，返回需要等待的时间
+func (T *connRate) reserve(dir int, n int) time.Duration {
+	var wait time.Duration
+	T.each(dir, func(rate float64, b *tokenBucket) bool {
+		if d := b.reserve(float64(n), rate); d > wait {
+			wait = d
+		}
+		return true
+	})
+	return wait
+}
+
+// allowPacket UDP数据报是否在限制内，超出时丢弃。被丢弃时退回之前各级取出的令牌
+func (T *connRate) allowPacket(dir int, n int) bool {
+	var packets *tokenBucket
+	if T.rl != nil {
+		if rate := T.rl.packets[dir].load(); rate > 0 {
+			if !T.packets[dir].take(1, rate) {
+				return false
+			}
+			packets = &T.packets[dir]
+		}
+	}
+	var (
+		taken [4]*tokenBucket
+		m     int
+	)
+	ok := T.each(dir, func(rate float64, b *tokenBucket) bool {
+		if !b.take(float64(n), rate) {
+			return false
+		}
+		taken[m] = b
+		m++
+		return true
+	})
+	if !ok {
+		for _, b := range taken[:m] {
+			b.refund(float64(n))
+		}
+		if packets != nil {
+			packets.refund(1)
+		}
+	}
+	return ok
+}
+
+// rateConn 读取时限制带宽
+type rateConn struct {
+	net.Conn
+	rate *connRate
+	dir  int
+	done chan struct{}
+	once sync.Once
+}
+
+func newRateConn(conn net.Conn, rate *connRate, dir int) *rateConn {
+	return &rateConn{Conn: conn, rate: rate, dir: dir, done: make(chan struct{})}
+}
+
+// RawConn 原连接
+func (T *rateConn) RawConn() net.Conn { return T.Conn }
+
+func (T *rateConn) Read(b []byte) (int, error) {
+	if size := T.rate.chunk(T.dir, len(b)); size < len(b) {
+		b = b[:size]
+	}
+	n, err := T.Conn.Read(b)
+	if n > 0 {
+		if wait := T.rate.reserve(T.dir, n); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-T.done:
+			}
+			timer.Stop()
+		}
+	}
+	return n, err
+}
+
+func (T *rateConn) Close() error {
+	T.once.Do(func() { close(T.done) })
+	return T.Conn.Close()
+}
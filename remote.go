@@ -0,0 +1,243 @@
+package vforward
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Balance 负载均衡策略
+type Balance int
+
+const (
+	BalanceRoundRobin       Balance = iota // 轮询
+	BalanceWeightRoundRobin                // 加权轮询
+	BalanceLeastConn                       // 最少连接
+	BalanceRandom                          // 随机
+	BalanceHash                            // 按客户端IP一致性哈希
+	BalanceFailover                        // 主备，按顺序选择第一个可用的远程，第一个为主其它为备
+)
+
+// 一致性哈希每个权重的虚拟节点数量
+const hashReplicas = 40
+
+// Remote 远程地址
+type Remote struct {
+	*Addr
+	Weight  int // 权重，加权轮询和一致性哈希使用（默认：1）
+	MaxConn int // 限制连接最大的数量（默认：0，不限制）
+
+	health              // 健康状态
+	currUseConn   int32 // 当前使用连接数量
+	currentWeight int   // 平滑加权轮询的当前权重
+}
+
+// ConnNum 当前正在转发的连接数量
+//
+//	int     实时连接数量
+func (T *Remote) ConnNum() int {
+	return int(atomic.LoadInt32(&T.currUseConn))
+}
+
+func (T *Remote) weight() int {
+	if T.Weight <= 0 {
+		return 1
+	}
+	return T.Weight
+}
+
+// 连接数量达到最大限制
+func (T *Remote) full() bool {
+	return T.MaxConn > 0 && T.ConnNum() >= T.MaxConn
+}
+
+// 占用一个连接数，达到最大限制返回false
+func (T *Remote) acquire() bool {
+	for {
+		n := atomic.LoadInt32(&T.currUseConn)
+		if T.MaxConn > 0 && int(n) >= T.MaxConn {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&T.currUseConn, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (T *Remote) release() {
+	atomic.AddInt32(&T.currUseConn, -1)
+}
+
+type hashNode struct {
+	hash   uint32
+	remote *Remote
+}
+
+// Remotes 远程地址组，每个连接按策略从中选出一个远程地址
+type Remotes struct {
+	Balance Balance // 负载均衡策略
+
+	list   []*Remote
+	ring   []hashNode // 一致性哈希环
+	next   uint32     // 轮询位置
+	active *Remote    // 主备当前使用的远程
+	mu     sync.Mutex // 加权轮询，主备锁
+}
+
+// NewRemotes 创建远程地址组
+//
+//	balance Balance     负载均衡策略
+//	rs ...*Remote       远程地址
+//	*Remotes            远程地址组
+func NewRemotes(balance Balance, rs ...*Remote) *Remotes {
+	T := &Remotes{Balance: balance, list: rs}
+	for _, r := range rs {
+		for i := 0; i < r.weight()*hashReplicas; i++ {
+			T.ring = append(T.ring, hashNode{
+				hash:   crc32.ChecksumIEEE([]byte(r.Remote.String() + "#" + strconv.Itoa(i))),
+				remote: r,
+			})
+		}
+	}
+	sort.Slice(T.ring, func(i, j int) bool { return T.ring[i].hash < T.ring[j].hash })
+	return T
+}
+
+// List 远程地址列表
+//
+//	[]*Remote   远程地址
+func (T *Remotes) List() []*Remote {
+	return T.list
+}
+
+// ConnNum 当前正在转发的连接数量
+//
+//	int     实时连接数量
+func (T *Remotes) ConnNum() (n int) {
+	for _, r := range T.list {
+		n += r.ConnNum()
+	}
+	return
+}
+
+// pick 选出一个远程地址并占用一个连接数，使用完需要调用 release 释放。
+//
+//	caddr net.Addr              客户端地址，一致性哈希使用
+//	skip func(*Remote) bool     跳过的远程地址，可以为nil
+//	*Remote                     远程地址，没有可用返回nil
+func (T *Remotes) pick(caddr net.Addr, skip func(*Remote) bool) *Remote {
+	tried := make(map[*Remote]bool)
+	for len(tried) < len(T.list) {
+		var cands []*Remote
+		for _, r := range T.list {
+			if tried[r] || r.full() || !r.Healthy() || (skip != nil && skip(r)) {
+				continue
+			}
+			cands = append(cands, r)
+		}
+		if len(cands) == 0 {
+			return nil
+		}
+		r := T.choose(cands, caddr)
+		if r.acquire() {
+			return r
+		}
+		// 并发下被占满
+		tried[r] = true
+	}
+	return nil
+}
+
+func (T *Remotes) choose(cands []*Remote, caddr net.Addr) *Remote {
+	if len(cands) == 1 {
+		return cands[0]
+	}
+	switch T.Balance {
+	case BalanceWeightRoundRobin:
+		// 平滑加权轮询
+		T.mu.Lock()
+		defer T.mu.Unlock()
+		var (
+			best  *Remote
+			total int
+		)
+		for _, r := range cands {
+			r.currentWeight += r.weight()
+			total += r.weight()
+			if best == nil || r.currentWeight > best.currentWeight {
+				best = r
+			}
+		}
+		best.currentWeight -= total
+		return best
+	case BalanceLeastConn:
+		best := cands[0]
+		for _, r := range cands[1:] {
+			// 按权重比较，r.conn/r.weight < best.conn/best.weight
+			if r.ConnNum()*best.weight() < best.ConnNum()*r.weight() {
+				best = r
+			}
+		}
+		return best
+	case BalanceRandom:
+		return cands[rand.Intn(len(cands))]
+	case BalanceHash:
+		if r := T.hashPick(cands, caddr); r != nil {
+			return r
+		}
+	case BalanceFailover:
+		return cands[0]
+	}
+	n := atomic.AddUint32(&T.next, 1)
+	return cands[(n-1)%uint32(len(cands))]
+}
+
+// setActive 设置主备当前使用的远程，返回上一次使用的远程
+func (T *Remotes) setActive(r *Remote) *Remote {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	prev := T.active
+	T.active = r
+	return prev
+}
+
+func (T *Remotes) hashPick(cands []*Remote, caddr net.Addr) *Remote {
+	if caddr == nil || len(T.ring) == 0 {
+		return nil
+	}
+	ok := make(map[*Remote]bool, len(cands))
+	for _, r := range cands {
+		ok[r] = true
+	}
+	h := crc32.ChecksumIEEE([]byte(addrHost(caddr)))
+	i := sort.Search(len(T.ring), func(i int) bool { return T.ring[i].hash >= h })
+	// 顺时针找到第一个可用的节点
+	for j := 0; j < len(T.ring); j++ {
+		node := T.ring[(i+j)%len(T.ring)]
+		if ok[node.remote] {
+			return node.remote
+		}
+	}
+	return nil
+}
+
+// 地址中的主机部分，不包含端口
+func addrHost(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.IPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
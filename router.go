@@ -0,0 +1,134 @@
+package vforward
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Router 按连接的首部数据选择远程，用于L2D的TCP连接
+type Router interface {
+	// Route 选择远程，返回的连接需要重放已读取的数据
+	//
+	//	conn net.Conn   客户端连接
+	//	net.Conn        替换客户端连接
+	//	*Remotes        远程，nil 使用 Transport 的远程
+	//	error           错误，连接将被关闭
+	Route(conn net.Conn) (net.Conn, *Remotes, error)
+}
+
+// 路由器中的全部远程，用于健康检查
+type routerRemotes interface {
+	Remotes() []*Remotes
+}
+
+// peekConn 重放已读取数据的连接
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// RawConn 原连接
+func (T *peekConn) RawConn() net.Conn { return T.Conn }
+
+func newPeekConn(conn net.Conn, size int) *peekConn {
+	return &peekConn{Conn: conn, r: bufio.NewReaderSize(conn, size)}
+}
+
+func (T *peekConn) Read(b []byte) (int, error) {
+	return T.r.Read(b)
+}
+
+// 读取首部超时
+func peekTimeout(d time.Duration) time.Time {
+	if d <= 0 {
+		d = 5 * time.Second
+	}
+	return time.Now().Add(d)
+}
+
+type hostRoute struct {
+	host string   // 主机名，*.example.com 匹配子域名，* 匹配全部
+	alpn []string // 应用层协议，空匹配全部
+	rs   *Remotes
+}
+
+// hostTable 主机名路由表。精确匹配优先，其次最长的通配符，最后 *。相同主机名时指定了协议的优先
+type hostTable struct {
+	routes []hostRoute
+	mu     sync.RWMutex
+}
+
+func (T *hostTable) add(host string, rs *Remotes, alpn []string) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.routes = append(T.routes, hostRoute{host: normalizeHost(host), alpn: alpn, rs: rs})
+}
+
+func (T *hostTable) lookup(host string, alpn []string) *Remotes {
+	host = normalizeHost(host)
+	T.mu.RLock()
+	defer T.mu.RUnlock()
+	var (
+		best  *Remotes
+		score = -1
+	)
+	for _, route := range T.routes {
+		s := hostScore(route.host, host)
+		if s < 0 {
+			continue
+		}
+		if len(route.alpn) != 0 {
+			if !hasCommon(route.alpn, alpn) {
+				continue
+			}
+			s++
+		}
+		if s > score {
+			best, score = route.rs, s
+		}
+	}
+	return best
+}
+
+func (T *hostTable) remotes() []*Remotes {
+	T.mu.RLock()
+	defer T.mu.RUnlock()
+	rss := make([]*Remotes, 0, len(T.routes))
+	for _, route := range T.routes {
+		rss = append(rss, route.rs)
+	}
+	return rss
+}
+
+// 主机名匹配得分，不匹配返回-1
+func hostScore(pattern, host string) int {
+	switch {
+	case pattern == "*":
+		return 0
+	case strings.HasPrefix(pattern, "*."):
+		if host != "" && strings.HasSuffix(host, pattern[1:]) {
+			return len(pattern) * 2
+		}
+	case pattern == host && host != "":
+		return 1 << 20
+	}
+	return -1
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func hasCommon(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,947 @@
+package vforward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-reuseport"
+)
+
+// 可靠UDP的包由多个段组成，每个段的头部：
+// conv(4) 连接号，cmd(1) 命令，wnd(2) 接收窗口剩余，ts(4) 发送时间，sn(4) 序号，una(4) 期望收到的序号，len(2) 数据长度
+const rudpHeader = 21
+
+// 段命令
+const (
+	rudpPush = iota + 1 // 数据
+	rudpSyn             // 建立连接，序号0
+	rudpFin             // 关闭连接
+	rudpAck             // 确认一个段，ts 为该段的发送时间
+	rudpPing            // 保活和窗口通知，不需要确认
+)
+
+// 关闭后等待数据发送完成和对方关闭的最长时间
+const rudpLinger = 10 * time.Second
+
+var (
+	errRUDPDeadLink = errors.New("vforward: 可靠UDP重传次数过多，连接断开")
+	errRUDPTimeout  = errors.New("vforward: 可靠UDP长时间没有收到对方数据，连接断开")
+)
+
+// RUDPConfig 可靠UDP设置，基于ARQ（选择确认，快速重传，拥塞窗口），在丢包的长距离链路上代替TCP
+type RUDPConfig struct {
+	MTU          int           // UDP包最大长度（默认：1400）
+	SendWindow   int           // 发送窗口，单位：段（默认：128）
+	RecvWindow   int           // 接收窗口，单位：段（默认：128）
+	Interval     time.Duration // 刷新间隔，发送确认和检查重传（默认：10ms）
+	MinRTO       time.Duration // 最小重传超时（默认：30ms）
+	FastResend   int           // 段被后面的确认跳过次数达到后快速重传，-1 关闭（默认：2）
+	NoCongestion bool          // 关闭拥塞控制，只受发送和接收窗口限制（默认：false）
+	DeadLink     int           // 同一个段发送次数超过后断开连接（默认：20）
+	KeepAlive    time.Duration // 空闲时发送保活的间隔，超过3倍没有收到对方数据断开连接（默认：10s）
+}
+
+func (T *RUDPConfig) withDefaults() RUDPConfig {
+	var c RUDPConfig
+	if T != nil {
+		c = *T
+	}
+	if c.MTU <= rudpHeader {
+		c.MTU = 1400
+	}
+	if c.SendWindow <= 0 {
+		c.SendWindow = 128
+	}
+	if c.RecvWindow <= 0 {
+		c.RecvWindow = 128
+	}
+	if c.RecvWindow > 0xffff {
+		c.RecvWindow = 0xffff
+	}
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Millisecond
+	}
+	if c.MinRTO <= 0 {
+		c.MinRTO = 30 * time.Millisecond
+	}
+	if c.FastResend == 0 {
+		c.FastResend = 2
+	}
+	if c.DeadLink <= 0 {
+		c.DeadLink = 20
+	}
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = 10 * time.Second
+	}
+	return c
+}
+
+// 可靠UDP的网络类型，rudp，rudp4，rudp6 对应 udp，udp4，udp6
+func isRUDP(network string) bool {
+	return strings.HasPrefix(network, "rudp")
+}
+
+func rudpNetwork(network string) string {
+	return strings.TrimPrefix(network, "r")
+}
+
+// 序号比较，允许回绕
+func rudpBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+type rudpSegment struct {
+	cmd    byte
+	sn     uint32
+	ts     uint32
+	data   []byte
+	xmit   int           // 发送次数
+	rto    time.Duration // 当前重传超时
+	resend time.Time     // 重传时间
+	skip   int           // 被后面的确认跳过次数
+}
+
+type rudpAckItem struct {
+	sn, ts uint32
+}
+
+// RUDPConn 可靠UDP连接，按数据流读写，和TCP连接一样使用
+type RUDPConn struct {
+	pc     net.PacketConn
+	raddr  net.Addr
+	conv   uint32
+	config RUDPConfig
+	owner  bool          // 独占 pc，关闭时一起关闭
+	l      *RUDPListener // 来自监听，关闭时从监听中删除
+
+	mu    sync.Mutex
+	start time.Time
+
+	// 发送
+	sndQueue []*rudpSegment // 等待进入发送窗口
+	sndBuf   []*rudpSegment // 已发送没有确认，按序号排列
+	sndNxt   uint32
+	sndUna   uint32
+	rmtWnd   int
+	cwnd     float64
+	ssthresh int
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+
+	// 接收
+	rcvBuf   map[uint32]*rudpSegment // 乱序到达
+	rcvQueue [][]byte                // 按顺序等待读取
+	rcvNxt   uint32
+	acks     []rudpAckItem
+	lastWnd  int // 上次告知对方的窗口
+
+	obuf     []byte
+	lastSend time.Time
+	lastRecv time.Time
+
+	estab     chan struct{} // 建立连接，序号0被确认
+	estabOnce sync.Once
+	eof       bool // 收到对方关闭
+	closing   bool // 本方已关闭
+	finSent   bool // 本方已发送关闭，不再写入
+	closeAt   time.Time
+	err       error // 连接断开的原因
+
+	kick       chan struct{}
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	done       chan struct{} // 不再读写
+	doneOnce   sync.Once
+	rdeadline  time.Time
+	wdeadline  time.Time
+}
+
+func newRUDPConn(pc net.PacketConn, raddr net.Addr, conv uint32, config RUDPConfig) *RUDPConn {
+	now := time.Now()
+	return &RUDPConn{
+		pc:         pc,
+		raddr:      raddr,
+		conv:       conv,
+		config:     config,
+		start:      now,
+		rmtWnd:     config.RecvWindow,
+		cwnd:       1,
+		ssthresh:   config.SendWindow,
+		rto:        200 * time.Millisecond,
+		rcvBuf:     make(map[uint32]*rudpSegment),
+		lastWnd:    config.RecvWindow,
+		lastSend:   now,
+		lastRecv:   now,
+		estab:      make(chan struct{}),
+		kick:       make(chan struct{}, 1),
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// DialRUDP 发起可靠UDP连接，对方确认后返回
+//
+//	ctx context.Context     上下文，用于连接超时
+//	network string          网络类型：rudp, rudp4, rudp6
+//	address string          远程地址
+//	config *RUDPConfig      设置，nil 使用默认设置
+//	*RUDPConn               连接
+//	error                   错误
+func DialRUDP(ctx context.Context, network, address string, config *RUDPConfig) (*RUDPConn, error) {
+	raddr, err := net.ResolveUDPAddr(rudpNetwork(network), address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(rudpNetwork(network), nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialRUDP(ctx, pc, raddr, config)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialRUDP 在 pc 上发起连接，连接独占 pc
+func dialRUDP(ctx context.Context, pc net.PacketConn, raddr net.Addr, config *RUDPConfig) (*RUDPConn, error) {
+	T := newRUDPConn(pc, raddr, rand.Uint32(), config.withDefaults())
+	T.owner = true
+	T.sndQueue = append(T.sndQueue, &rudpSegment{cmd: rudpSyn})
+	go T.readLoop()
+	go T.run()
+
+	select {
+	case <-T.estab:
+		return T, nil
+	case <-T.done:
+		T.mu.Lock()
+		err := T.err
+		T.mu.Unlock()
+		return nil, err
+	case <-ctx.Done():
+		T.mu.Lock()
+		T.fail(ctx.Err())
+		T.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// 客户端读取 pc
+func (T *RUDPConn) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := T.pc.ReadFrom(buf)
+		if err != nil {
+			T.mu.Lock()
+			T.fail(err)
+			T.mu.Unlock()
+			return
+		}
+		if addr.String() == T.raddr.String() {
+			T.input(buf[:n])
+		}
+	}
+}
+
+// run 定时刷新，直到连接结束
+func (T *RUDPConn) run() {
+	ticker := time.NewTicker(T.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-T.kick:
+		}
+		T.mu.Lock()
+		now := time.Now()
+		if T.err == nil && now.Sub(T.lastRecv) > 3*T.config.KeepAlive {
+			T.fail(errRUDPTimeout)
+		}
+		if T.err == nil {
+			T.flush(now)
+		}
+		finished := T.err != nil || T.closing && (now.After(T.closeAt) || T.eof && len(T.sndQueue) == 0 && len(T.sndBuf) == 0)
+		T.mu.Unlock()
+		if finished {
+			T.release()
+			return
+		}
+	}
+}
+
+// fail 连接断开，需要持有锁
+func (T *RUDPConn) fail(err error) {
+	if T.err == nil {
+		T.err = err
+	}
+	T.doneOnce.Do(func() { close(T.done) })
+}
+
+// release 释放连接占用的资源
+func (T *RUDPConn) release() {
+	T.mu.Lock()
+	T.fail(net.ErrClosed)
+	T.mu.Unlock()
+	if T.owner {
+		T.pc.Close()
+	}
+	if T.l != nil {
+		T.l.remove(T)
+	}
+}
+
+func (T *RUDPConn) notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (T *RUDPConn) now() uint32 {
+	return uint32(time.Since(T.start) / time.Millisecond)
+}
+
+// recvWnd 接收窗口剩余
+func (T *RUDPConn) recvWnd() int {
+	if n := T.config.RecvWindow - len(T.rcvQueue); n > 0 {
+		return n
+	}
+	return 0
+}
+
+func (T *RUDPConn) encode(b []byte, cmd byte, wnd int, ts, sn uint32, data []byte) []byte {
+	var h [rudpHeader]byte
+	binary.BigEndian.PutUint32(h[0:], T.conv)
+	h[4] = cmd
+	binary.BigEndian.PutUint16(h[5:], uint16(wnd))
+	binary.BigEndian.PutUint32(h[7:], ts)
+	binary.BigEndian.PutUint32(h[11:], sn)
+	binary.BigEndian.PutUint32(h[15:], T.rcvNxt)
+	binary.BigEndian.PutUint16(h[19:], uint16(len(data)))
+	return append(append(b, h[:]...), data...)
+}
+
+// output 发送一个包
+func (T *RUDPConn) output(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	T.pc.WriteTo(b, T.raddr)
+	T.lastSend = time.Now()
+}
+
+// flush 发送确认，新数据和需要重传的段，需要持有锁
+func (T *RUDPConn) flush(now time.Time) {
+	buf := T.obuf[:0]
+	wnd := T.recvWnd()
+	ts := T.now()
+	add := func(cmd byte, ts, sn uint32, data []byte) {
+		if len(buf)+rudpHeader+len(data) > T.config.MTU {
+			T.output(buf)
+			buf = buf[:0]
+		}
+		buf = T.encode(buf, cmd, wnd, ts, sn, data)
+	}
+
+	// 确认
+	for _, ack := range T.acks {
+		add(rudpAck, ack.ts, ack.sn, nil)
+	}
+	T.acks = T.acks[:0]
+
+	// 保活，或窗口从0恢复时通知对方
+	if now.Sub(T.lastSend) >= T.config.KeepAlive || T.lastWnd == 0 && wnd > 0 {
+		add(rudpPing, ts, 0, nil)
+	}
+	T.lastWnd = wnd
+
+	// 新数据进入发送窗口，对方窗口为0时仍然发送一个段用于探测
+	limit := T.config.SendWindow
+	if T.rmtWnd < limit {
+		limit = T.rmtWnd
+	}
+	if !T.config.NoCongestion && int(T.cwnd) < limit {
+		limit = int(T.cwnd)
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	moved := false
+	for len(T.sndQueue) != 0 && int(T.sndNxt-T.sndUna) < limit {
+		seg := T.sndQueue[0]
+		T.sndQueue[0] = nil
+		T.sndQueue = T.sndQueue[1:]
+		seg.sn = T.sndNxt
+		T.sndNxt++
+		T.sndBuf = append(T.sndBuf, seg)
+		moved = true
+	}
+	if moved {
+		T.notify(T.writeEvent)
+	}
+
+	// 发送和重传
+	var lost, fast bool
+	for _, seg := range T.sndBuf {
+		send := false
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = T.rto
+		case !now.Before(seg.resend):
+			send, lost = true, true
+			if seg.rto += seg.rto / 2; seg.rto > 5*time.Second {
+				seg.rto = 5 * time.Second
+			}
+		case T.config.FastResend > 0 && seg.skip >= T.config.FastResend:
+			send, fast = true, true
+		}
+		if !send {
+			continue
+		}
+		seg.xmit++
+		seg.skip = 0
+		seg.ts = ts
+		seg.resend = now.Add(seg.rto)
+		add(seg.cmd, seg.ts, seg.sn, seg.data)
+		if seg.xmit > T.config.DeadLink {
+			T.fail(errRUDPDeadLink)
+		}
+	}
+	T.output(buf)
+	T.obuf = buf
+
+	// 拥塞控制，快速重传时减半，超时重传时重新慢启动
+	if !T.config.NoCongestion {
+		inflight := int(T.sndNxt - T.sndUna)
+		if fast {
+			T.ssthresh = inflight / 2
+			if T.ssthresh < 2 {
+				T.ssthresh = 2
+			}
+			T.cwnd = float64(T.ssthresh + T.config.FastResend)
+		}
+		if lost {
+			T.ssthresh = int(T.cwnd) / 2
+			if T.ssthresh < 2 {
+				T.ssthresh = 2
+			}
+			T.cwnd = 1
+		}
+	}
+}
+
+// input 处理收到的包
+func (T *RUDPConn) input(p []byte) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	if T.err != nil {
+		return
+	}
+	T.lastRecv = time.Now()
+	una := T.sndUna
+	var (
+		maxAck uint32
+		hasAck bool
+	)
+	for len(p) >= rudpHeader {
+		conv := binary.BigEndian.Uint32(p)
+		cmd := p[4]
+		wnd := int(binary.BigEndian.Uint16(p[5:]))
+		ts := binary.BigEndian.Uint32(p[7:])
+		sn := binary.BigEndian.Uint32(p[11:])
+		rcvUna := binary.BigEndian.Uint32(p[15:])
+		size := int(binary.BigEndian.Uint16(p[19:]))
+		if conv != T.conv || len(p) < rudpHeader+size {
+			break
+		}
+		data := p[rudpHeader : rudpHeader+size]
+		p = p[rudpHeader+size:]
+
+		T.rmtWnd = wnd
+		T.ackUna(rcvUna)
+		switch cmd {
+		case rudpAck:
+			T.ackSegment(sn, ts)
+			if !hasAck || rudpBefore(maxAck, sn) {
+				maxAck, hasAck = sn, true
+			}
+		case rudpPush, rudpSyn, rudpFin:
+			if !rudpBefore(sn, T.rcvNxt+uint32(T.config.RecvWindow)) {
+				// 超出接收窗口
+				continue
+			}
+			T.acks = append(T.acks, rudpAckItem{sn: sn, ts: ts})
+			if rudpBefore(sn, T.rcvNxt) {
+				// 重复
+				continue
+			}
+			if _, ok := T.rcvBuf[sn]; !ok {
+				T.rcvBuf[sn] = &rudpSegment{cmd: cmd, sn: sn, data: append([]byte(nil), data...)}
+			}
+		}
+	}
+
+	// 选择确认，跳过的段可能已经丢失
+	if hasAck {
+		for _, seg := range T.sndBuf {
+			if !rudpBefore(seg.sn, maxAck) {
+				break
+			}
+			seg.skip++
+		}
+	}
+
+	// 有新的确认，增加拥塞窗口
+	if T.sndUna != una && !T.config.NoCongestion {
+		if T.cwnd < float64(T.ssthresh) {
+			T.cwnd++
+		} else {
+			T.cwnd += 1 / T.cwnd
+		}
+		if T.cwnd > float64(T.config.SendWindow) {
+			T.cwnd = float64(T.config.SendWindow)
+		}
+	}
+	if T.sndUna != una {
+		T.estabOnce.Do(func() { close(T.estab) })
+	}
+
+	T.moveRecv()
+	T.notify(T.kick)
+}
+
+// ackUna 删除 una 之前的段
+func (T *RUDPConn) ackUna(una uint32) {
+	n := 0
+	for n < len(T.sndBuf) && rudpBefore(T.sndBuf[n].sn, una) {
+		n++
+	}
+	if n != 0 {
+		T.sndBuf = append(T.sndBuf[:0], T.sndBuf[n:]...)
+	}
+	T.updateUna()
+}
+
+// ackSegment 删除已确认的段，更新往返时间
+func (T *RUDPConn) ackSegment(sn, ts uint32) {
+	for i, seg := range T.sndBuf {
+		if seg.sn == sn {
+			if seg.ts == ts {
+				T.updateRTT(time.Duration(T.now()-ts) * time.Millisecond)
+			}
+			T.sndBuf = append(T.sndBuf[:i], T.sndBuf[i+1:]...)
+			break
+		}
+		if rudpBefore(sn, seg.sn) {
+			break
+		}
+	}
+	T.updateUna()
+}
+
+func (T *RUDPConn) updateUna() {
+	if len(T.sndBuf) != 0 {
+		T.sndUna = T.sndBuf[0].sn
+	} else {
+		T.sndUna = T.sndNxt
+	}
+}
+
+func (T *RUDPConn) updateRTT(rtt time.Duration) {
+	if T.srtt == 0 {
+		T.srtt, T.rttvar = rtt, rtt/2
+	} else {
+		delta := rtt - T.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		T.rttvar = (3*T.rttvar + delta) / 4
+		T.srtt = (7*T.srtt + rtt) / 8
+	}
+	vary := 4 * T.rttvar
+	if vary < T.config.Interval {
+		vary = T.config.Interval
+	}
+	T.rto = T.srtt + vary
+	if T.rto < T.config.MinRTO {
+		T.rto = T.config.MinRTO
+	}
+	if T.rto > 60*time.Second {
+		T.rto = 60 * time.Second
+	}
+}
+
+// moveRecv 按顺序的段移入读取队列
+func (T *RUDPConn) moveRecv() {
+	moved := false
+	for len(T.rcvQueue) < T.config.RecvWindow {
+		seg, ok := T.rcvBuf[T.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(T.rcvBuf, T.rcvNxt)
+		T.rcvNxt++
+		switch seg.cmd {
+		case rudpPush:
+			if len(seg.data) != 0 {
+				T.rcvQueue = append(T.rcvQueue, seg.data)
+			}
+		case rudpFin:
+			T.eof = true
+		}
+		moved = true
+	}
+	if moved {
+		T.notify(T.readEvent)
+	}
+}
+
+// wait 等待事件，直到超时或连接结束
+func (T *RUDPConn) wait(ev chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ev:
+	case <-T.done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Read 读取数据，对方关闭后返回 io.EOF
+func (T *RUDPConn) Read(b []byte) (int, error) {
+	for {
+		T.mu.Lock()
+		if T.closing {
+			T.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(T.rcvQueue) != 0 {
+			wnd := T.recvWnd()
+			n := 0
+			for n < len(b) && len(T.rcvQueue) != 0 {
+				c := copy(b[n:], T.rcvQueue[0])
+				n += c
+				if c == len(T.rcvQueue[0]) {
+					T.rcvQueue[0] = nil
+					T.rcvQueue = T.rcvQueue[1:]
+				} else {
+					T.rcvQueue[0] = T.rcvQueue[0][c:]
+				}
+			}
+			T.moveRecv()
+			if wnd == 0 && T.recvWnd() > 0 {
+				// 窗口恢复，尽快通知对方
+				T.notify(T.kick)
+			}
+			T.mu.Unlock()
+			return n, nil
+		}
+		if T.eof {
+			T.mu.Unlock()
+			return 0, io.EOF
+		}
+		if T.err != nil {
+			err := T.err
+			T.mu.Unlock()
+			return 0, err
+		}
+		deadline := T.rdeadline
+		T.mu.Unlock()
+		if err := T.wait(T.readEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write 写入数据，发送队列满时等待
+func (T *RUDPConn) Write(b []byte) (int, error) {
+	mss := T.config.MTU - rudpHeader
+	n := 0
+	for n < len(b) {
+		T.mu.Lock()
+		if T.closing || T.finSent {
+			T.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if T.err != nil {
+			err := T.err
+			T.mu.Unlock()
+			return n, err
+		}
+		if len(T.sndQueue) < T.config.SendWindow {
+			for n < len(b) && len(T.sndQueue) < T.config.SendWindow {
+				size := len(b) - n
+				if size > mss {
+					size = mss
+				}
+				T.sndQueue = append(T.sndQueue, &rudpSegment{cmd: rudpPush, data: append([]byte(nil), b[n:n+size]...)})
+				n += size
+			}
+			T.mu.Unlock()
+			T.notify(T.kick)
+			continue
+		}
+		deadline := T.wdeadline
+		T.mu.Unlock()
+		if err := T.wait(T.writeEvent, deadline); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close 关闭连接，已写入的数据在后台继续发送
+func (T *RUDPConn) Close() error {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	if T.closing {
+		return nil
+	}
+	T.closing = true
+	T.closeAt = time.Now().Add(rudpLinger)
+	if T.err == nil && !T.finSent {
+		T.finSent = true
+		T.sndQueue = append(T.sndQueue, &rudpSegment{cmd: rudpFin})
+	}
+	T.notify(T.readEvent)
+	T.notify(T.writeEvent)
+	T.notify(T.kick)
+	return nil
+}
+
+// CloseWrite 半关闭，已写入的数据发送完成后对方读取到 io.EOF，本方仍然可以读取
+func (T *RUDPConn) CloseWrite() error {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	if T.closing || T.finSent {
+		return net.ErrClosed
+	}
+	if T.err != nil {
+		return T.err
+	}
+	T.finSent = true
+	T.sndQueue = append(T.sndQueue, &rudpSegment{cmd: rudpFin})
+	T.notify(T.writeEvent)
+	T.notify(T.kick)
+	return nil
+}
+
+// LocalAddr 本地地址
+func (T *RUDPConn) LocalAddr() net.Addr {
+	return T.pc.LocalAddr()
+}
+
+// RemoteAddr 远程地址
+func (T *RUDPConn) RemoteAddr() net.Addr {
+	return T.raddr
+}
+
+// SetDeadline 设置读写超时
+func (T *RUDPConn) SetDeadline(t time.Time) error {
+	T.SetReadDeadline(t)
+	return T.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 设置读取超时
+func (T *RUDPConn) SetReadDeadline(t time.Time) error {
+	T.mu.Lock()
+	T.rdeadline = t
+	T.mu.Unlock()
+	T.notify(T.readEvent)
+	return nil
+}
+
+// SetWriteDeadline 设置写入超时
+func (T *RUDPConn) SetWriteDeadline(t time.Time) error {
+	T.mu.Lock()
+	T.wdeadline = t
+	T.mu.Unlock()
+	T.notify(T.writeEvent)
+	return nil
+}
+
+type rudpKey struct {
+	addr string
+	conv uint32
+}
+
+// RUDPListener 可靠UDP监听，多个连接共用一个UDP端口。关闭监听同时断开全部连接
+type RUDPListener struct {
+	pc     net.PacketConn
+	config RUDPConfig
+	conns  map[rudpKey]*RUDPConn
+	mu     sync.Mutex
+	accept chan *RUDPConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// ListenRUDP 监听可靠UDP
+//
+//	network string          网络类型：rudp, rudp4, rudp6
+//	address string          监听地址
+//	config *RUDPConfig      设置，nil 使用默认设置
+//	*RUDPListener           监听
+//	error                   错误
+func ListenRUDP(network, address string, config *RUDPConfig) (*RUDPListener, error) {
+	pc, err := reuseport.ListenPacket(rudpNetwork(network), address)
+	if err != nil {
+		return nil, err
+	}
+	return ServeRUDP(pc, config), nil
+}
+
+// ServeRUDP 在已有的UDP连接上监听可靠UDP
+//
+//	pc net.PacketConn       UDP连接
+//	config *RUDPConfig      设置，nil 使用默认设置
+//	*RUDPListener           监听
+func ServeRUDP(pc net.PacketConn, config *RUDPConfig) *RUDPListener {
+	T := &RUDPListener{
+		pc:     pc,
+		config: config.withDefaults(),
+		conns:  make(map[rudpKey]*RUDPConn),
+		accept: make(chan *RUDPConn, 128),
+		done:   make(chan struct{}),
+	}
+	go T.readLoop()
+	return T
+}
+
+func (T *RUDPListener) readLoop() {
+	defer T.Close()
+	buf := make([]byte, 65536)
+	var tempDelay time.Duration
+	for {
+		n, addr, err := T.pc.ReadFrom(buf)
+		if err != nil {
+			var ok bool
+			if tempDelay, ok = temporaryError(err, tempDelay, time.Second); ok {
+				continue
+			}
+			return
+		}
+		tempDelay = 0
+		if n < rudpHeader {
+			continue
+		}
+		key := rudpKey{addr: addr.String(), conv: binary.BigEndian.Uint32(buf)}
+		T.mu.Lock()
+		conn, ok := T.conns[key]
+		if !ok && buf[4] == rudpSyn && binary.BigEndian.Uint32(buf[11:]) == 0 {
+			// 新连接
+			select {
+			case <-T.done:
+			default:
+				conn = newRUDPConn(T.pc, addr, key.conv, T.config)
+				conn.l = T
+				select {
+				case T.accept <- conn:
+					T.conns[key] = conn
+					go conn.run()
+				default:
+					// 等待接受的连接太多
+					conn = nil
+				}
+			}
+		}
+		T.mu.Unlock()
+		if conn != nil {
+			conn.input(buf[:n])
+		}
+	}
+}
+
+func (T *RUDPListener) remove(conn *RUDPConn) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	key := rudpKey{addr: conn.raddr.String(), conv: conn.conv}
+	if T.conns[key] == conn {
+		delete(T.conns, key)
+	}
+}
+
+// Accept 等待新连接
+//
+//	net.Conn    连接
+//	error       错误
+func (T *RUDPListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-T.accept:
+		return conn, nil
+	case <-T.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭监听，同时断开全部连接
+//
+//	error   错误
+func (T *RUDPListener) Close() error {
+	T.once.Do(func() {
+		close(T.done)
+		T.pc.Close()
+		T.mu.Lock()
+		conns := T.conns
+		T.conns = make(map[rudpKey]*RUDPConn)
+		T.mu.Unlock()
+		for _, conn := range conns {
+			conn.mu.Lock()
+			conn.fail(net.ErrClosed)
+			conn.mu.Unlock()
+			conn.notify(conn.kick)
+		}
+	})
+	return nil
+}
+
+// Addr 监听地址
+//
+//	net.Addr    地址
+func (T *RUDPListener) Addr() net.Addr {
+	return T.pc.LocalAddr()
+}
+
+// rudpDialer 网络类型是可靠UDP时发起可靠UDP连接
+type rudpDialer struct {
+	*net.Dialer
+	config *RUDPConfig
+}
+
+func (T *rudpDialer) Dial(network, address string) (net.Conn, error) {
+	return T.DialContext(context.Background(), network, address)
+}
+
+func (T *rudpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if isRUDP(network) {
+		conn, err := DialRUDP(ctx, network, address, T.config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return T.Dialer.DialContext(ctx, network, address)
+}
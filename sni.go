@@ -0,0 +1,244 @@
+package vforward
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// TLS记录最大长度
+const tlsMaxRecord = 16384
+
+// SNIRouter 按TLS ClientHello中的SNI和ALPN选择远程，不解密TLS，读取的数据原样转发给远程。
+// 不是TLS连接或没有匹配的路由时使用 Default。
+type SNIRouter struct {
+	Timeout time.Duration // 读取ClientHello超时（默认：5s）
+	Default *Remotes      // 默认路由（默认：nil，使用 Transport 的远程）
+
+	table hostTable
+}
+
+// Add 添加路由
+//
+//	host string         主机名，*.example.com 匹配全部子域名，* 匹配全部主机名
+//	rs *Remotes         远程
+//	alpn ...string      应用层协议，客户端提供其中之一才匹配，不填匹配全部
+func (T *SNIRouter) Add(host string, rs *Remotes, alpn ...string) {
+	T.table.add(host, rs, alpn)
+}
+
+// Remotes 路由中的全部远程
+//
+//	[]*Remotes  远程
+func (T *SNIRouter) Remotes() []*Remotes {
+	rss := T.table.remotes()
+	if T.Default != nil {
+		rss = append(rss, T.Default)
+	}
+	return rss
+}
+
+// Route 选择远程，见 Router
+func (T *SNIRouter) Route(conn net.Conn) (net.Conn, *Remotes, error) {
+	if err := conn.SetReadDeadline(peekTimeout(T.Timeout)); err != nil {
+		return nil, nil, err
+	}
+	pc := newPeekConn(conn, tlsMaxRecord+5)
+	sni, alpn, err := peekClientHello(pc)
+	if err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, nil, err
+		}
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	if rs := T.table.lookup(sni, alpn); rs != nil {
+		return pc, rs, nil
+	}
+	return pc, T.Default, nil
+}
+
+var errNotClientHello = errors.New("vforward: 不是TLS ClientHello")
+
+// peekClientHello 读取但不消耗ClientHello，返回SNI和ALPN。不是TLS连接返回空
+func peekClientHello(pc *peekConn) (string, []string, error) {
+	head, err := pc.r.Peek(5)
+	if err != nil {
+		if len(head) != 0 {
+			// 数据不足5字节，不是TLS
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+	// 记录类型 handshake，版本 3.x
+	if head[0] != 0x16 || head[1] != 0x03 {
+		return "", nil, nil
+	}
+	size := int(binary.BigEndian.Uint16(head[3:]))
+	if size > tlsMaxRecord {
+		return "", nil, nil
+	}
+	record, err := pc.r.Peek(5 + size)
+	if err != nil {
+		return "", nil, err
+	}
+	sni, alpn, err := parseClientHello(record[5:])
+	if err != nil {
+		// 格式错误交给远程处理
+		return "", nil, nil
+	}
+	return sni, alpn, nil
+}
+
+// parseClientHello 解析ClientHello消息，只支持在一个记录中的消息
+func parseClientHello(b []byte) (sni string, alpn []string, err error) {
+	r := cursor(b)
+	typ, ok := r.uint8()
+	if !ok || typ != 0x01 {
+		return "", nil, errNotClientHello
+	}
+	msg, ok := r.bytes24()
+	if !ok {
+		if len(r) < 3 {
+			return "", nil, errNotClientHello
+		}
+		// 消息跨越多个记录，只解析当前记录中的部分
+		msg = r[3:]
+	}
+	r = cursor(msg)
+	// 版本，随机数
+	if !r.skip(2 + 32) {
+		return "", nil, errNotClientHello
+	}
+	// 会话ID，密码套件，压缩方法
+	if _, ok = r.bytes8(); !ok {
+		return "", nil, errNotClientHello
+	}
+	if _, ok = r.bytes16(); !ok {
+		return "", nil, errNotClientHello
+	}
+	if _, ok = r.bytes8(); !ok {
+		return "", nil, errNotClientHello
+	}
+	exts, ok := r.bytes16()
+	if !ok {
+		return "", nil, nil
+	}
+	r = cursor(exts)
+	for len(r) > 0 {
+		typ, ok1 := r.uint16()
+		data, ok2 := r.bytes16()
+		if !ok1 || !ok2 {
+			break
+		}
+		d := cursor(data)
+		switch typ {
+		case 0x0000: // server_name
+			list, ok := d.bytes16()
+			if !ok {
+				continue
+			}
+			l := cursor(list)
+			for len(l) > 0 {
+				nameType, ok1 := l.uint8()
+				name, ok2 := l.bytes16()
+				if !ok1 || !ok2 {
+					break
+				}
+				if nameType == 0 {
+					sni = string(name)
+				}
+			}
+		case 0x0010: // application_layer_protocol_negotiation
+			list, ok := d.bytes16()
+			if !ok {
+				continue
+			}
+			l := cursor(list)
+			for len(l) > 0 {
+				proto, ok := l.bytes8()
+				if !ok {
+					break
+				}
+				alpn = append(alpn, string(proto))
+			}
+		}
+	}
+	return sni, alpn, nil
+}
+
+// cursor 按顺序读取字节
+type cursor []byte
+
+func (T *cursor) skip(n int) bool {
+	if len(*T) < n {
+		return false
+	}
+	*T = (*T)[n:]
+	return true
+}
+
+func (T *cursor) uint8() (byte, bool) {
+	if len(*T) < 1 {
+		return 0, false
+	}
+	v := (*T)[0]
+	*T = (*T)[1:]
+	return v, true
+}
+
+func (T *cursor) uint16() (uint16, bool) {
+	if len(*T) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*T)
+	*T = (*T)[2:]
+	return v, true
+}
+
+func (T *cursor) read(n int) ([]byte, bool) {
+	if len(*T) < n {
+		return nil, false
+	}
+	v := (*T)[:n]
+	*T = (*T)[n:]
+	return v, true
+}
+
+func (T *cursor) bytes8() ([]byte, bool) {
+	if len(*T) < 1 {
+		return nil, false
+	}
+	n := int((*T)[0])
+	if len(*T) < 1+n {
+		return nil, false
+	}
+	*T = (*T)[1:]
+	return T.read(n)
+}
+
+func (T *cursor) bytes16() ([]byte, bool) {
+	if len(*T) < 2 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(*T))
+	if len(*T) < 2+n {
+		return nil, false
+	}
+	*T = (*T)[2:]
+	return T.read(n)
+}
+
+func (T *cursor) bytes24() ([]byte, bool) {
+	if len(*T) < 3 {
+		return nil, false
+	}
+	n := int((*T)[0])<<16 | int((*T)[1])<<8 | int((*T)[2])
+	if len(*T) < 3+n {
+		return nil, false
+	}
+	*T = (*T)[3:]
+	return T.read(n)
+}
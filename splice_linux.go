@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+package vforward
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1 // SPLICE_F_MOVE
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+
+	// 每次从连接移入管道的最大长度
+	maxSpliceSize = 1 << 20
+)
+
+// spliceable 可以使用 splice 的连接
+func spliceable(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return true
+	case *net.UnixConn:
+		// 数据报类型的Unix连接不能合并数据
+		return c.LocalAddr().Network() == "unix"
+	}
+	return false
+}
+
+// spliceConn 双方都是TCP或Unix连接时，通过管道使用 splice 复制数据，实时累加到 count。
+// 不能使用 splice 时 handled 返回 false，没有读取任何数据
+func spliceConn(dst, src net.Conn, count *int64) (written int64, handled bool, err error) {
+	wconn, _ := directConn(dst, false)
+	if !spliceable(wconn) {
+		return 0, false, nil
+	}
+	rconn, buffered := directConn(src, true)
+	if !spliceable(rconn) {
+		return 0, false, nil
+	}
+	wsc, err := wconn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	rsc, err := rconn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	// 先转发包装中已读取的数据，这部分数据不会再从原连接读取
+	if buffered > 0 {
+		buf := make([]byte, buffered)
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			atomic.AddInt64(count, int64(m))
+			if werr != nil {
+				return written, true, werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return written, true, err
+		}
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return written, true, os.NewSyscallError("pipe2", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	for {
+		// 连接 → 管道
+		n, err := spliceRaw(rsc, false, p[1], maxSpliceSize)
+		if err != nil {
+			return written, true, err
+		}
+		if n == 0 {
+			// 读取结束
+			return written, true, nil
+		}
+		// 管道 → 连接
+		for n > 0 {
+			m, err := spliceRaw(wsc, true, p[0], int(n))
+			written += m
+			atomic.AddInt64(count, m)
+			if err != nil {
+				return written, true, err
+			}
+			n -= m
+		}
+	}
+}
+
+// spliceRaw 在连接和管道之间移动数据，连接暂时不能读写时等待
+//
+//	rc syscall.RawConn  连接
+//	write bool          true 从管道写入连接，false 从连接读取到管道
+//	pipe int            管道的一端
+//	size int            最大长度
+//	int64               移动的字节数
+//	error               错误
+func spliceRaw(rc syscall.RawConn, write bool, pipe int, size int) (int64, error) {
+	var (
+		n    int64
+		serr error
+	)
+	f := func(fd uintptr) bool {
+		for {
+			if write {
+				n, serr = syscall.Splice(pipe, nil, int(fd), nil, size, spliceMove|spliceNonblock)
+			} else {
+				n, serr = syscall.Splice(int(fd), nil, pipe, nil, size, spliceMove|spliceNonblock)
+			}
+			if serr != syscall.EINTR {
+				return serr != syscall.EAGAIN
+			}
+		}
+	}
+	var err error
+	if write {
+		err = rc.Write(f)
+	} else {
+		err = rc.Read(f)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, os.NewSyscallError("splice", serr)
+	}
+	return n, nil
+}
@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package vforward
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/issue9/assert/v2"
+)
+
+// tcpPair 返回一对互相连接的TCP连接
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c, s
+}
+
+// 包装中已读取的数据先转发，之后使用 splice
+func Test_spliceConn(t *testing.T) {
+	as := assert.New(t, true)
+
+	sc, src := tcpPair(t)
+	defer sc.Close()
+	dst, dc := tcpPair(t)
+	defer dc.Close()
+
+	data := bytes.Repeat([]byte("splice"), 100000)
+	go func() {
+		sc.Write(data)
+		sc.Close()
+	}()
+
+	pc := newPeekConn(src, 4096)
+	_, err := pc.r.Peek(10)
+	as.NotError(err)
+	wrapped := &limitConn{Conn: pc, release: func() {}}
+
+	done := make(chan []byte)
+	go func() {
+		dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, _ := io.ReadAll(dc)
+		done <- b
+	}()
+
+	n, handled, err := spliceConn(dst, wrapped, new(int64))
+	as.NotError(err).True(handled).Equal(n, int64(len(data)))
+	dst.Close()
+	as.Equal(<-done, data)
+
+	// UDP不能使用 splice
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	as.NotError(err)
+	defer uc.Close()
+	_, handled, _ = spliceConn(dst, uc, new(int64))
+	as.False(handled)
+}
+
+// cpuTime 进程使用的CPU时间
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// benchmarkCopy 经过包装的TCP连接之间复制数据，报告吞吐量和每GB使用的CPU时间
+func benchmarkCopy(b *testing.B, copy func(dst, src net.Conn) (int64, error)) {
+	const chunk = 1 << 20
+
+	sc, src := tcpPair(b)
+	defer src.Close()
+	dst, dc := tcpPair(b)
+	defer dc.Close()
+
+	go func() {
+		buf := make([]byte, chunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := sc.Write(buf); err != nil {
+				break
+			}
+		}
+		sc.Close()
+	}()
+	go io.Copy(io.Discard, dc)
+
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	cpu := cpuTime()
+	n, err := copy(&limitConn{Conn: dst, release: func() {}}, &limitConn{Conn: src, release: func() {}})
+	cpu = cpuTime() - cpu
+	b.StopTimer()
+	dst.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if n != int64(b.N)*chunk {
+		b.Fatalf("复制 %d 字节，需要 %d 字节", n, int64(b.N)*chunk)
+	}
+	b.ReportMetric(cpu.Seconds()/(float64(n)/(1<<30)), "cpu-s/GB")
+}
+
+func Benchmark_copyConn_Splice(b *testing.B) {
+	benchmarkCopy(b, func(dst, src net.Conn) (int64, error) {
+		return copyConn(dst, src, DefaultReadBufSize, new(int64))
+	})
+}
+
+// 原来的复制方式，ReadBufSize 缓冲
+func Benchmark_copyConn_ReadBufSize(b *testing.B) {
+	benchmarkCopy(b, func(dst, src net.Conn) (int64, error) {
+		return io.CopyBuffer(dst, src, make([]byte, DefaultReadBufSize))
+	})
+}
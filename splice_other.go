@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package vforward
+
+import "net"
+
+// spliceConn 仅Linux支持 splice，其它系统使用缓冲复制
+func spliceConn(dst, src net.Conn, count *int64) (written int64, handled bool, err error) {
+	return 0, false, nil
+}
@@ -0,0 +1,153 @@
+package vforward
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DialErrorReasons 发起连接失败的原因，Stats.DialErrors 按这个顺序计数
+var DialErrorReasons = [...]string{"timeout", "refused", "unreachable", "tls", "other"}
+
+// DialLatencyBuckets 发起连接耗时直方图的区间上限
+var DialLatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Stats 交换的统计快照。
+// 上行：L2D客户端发往远程，D2D和L2L的A方发往B方；下行：反方向
+type Stats struct {
+	Conns          int           // 当前正在转发的连接数量
+	BytesIn        int64         // 上行字节数
+	BytesOut       int64         // 下行字节数
+	PacketsIn      int64         // UDP上行数据报数量
+	PacketsOut     int64         // UDP下行数据报数量
+	Accepted       int64         // 通过访问控制和连接限制的连接，不含 Rejected，L2D为客户端连接和UDP会话，L2L为A，B双方的连接，D2D不接受连接为0
+	Rejected       int64         // 被访问控制，连接数量或连接限制拒绝的连接，以及读取PROXY协议头失败的连接
+	Failed         int64         // 失败的连接，L2D为路由失败或没有可用的远程，D2D为发起连接失败，L2L为发送PROXY协议头失败
+	Completed      int64         // 交换完成的连接，UDP为结束的会话
+	VerifyFailed   int64         // TLS握手，身份验证或验证函数失败的连接
+	Dials          int64         // 发起成功的连接数量
+	DialLatency    time.Duration // 发起连接的平均耗时
+	DialLatencyMax time.Duration // 发起连接的最大耗时
+
+	DialLatencySum time.Duration                  // 发起连接的总耗时
+	DialHistogram  [len(DialLatencyBuckets)]int64 // 发起连接耗时不大于 DialLatencyBuckets 对应区间的数量（累计）
+	DialErrors     [len(DialErrorReasons)]int64   // 发起连接失败的数量，按 DialErrorReasons 的原因区分
+	Idle           []int                          // D2D和L2L池中A，B方的空闲连接数量，L2D为nil
+}
+
+// swapStats 交换的计数，全部使用原子操作。需要单独分配，保证64位对齐
+type swapStats struct {
+	bytes        [2]int64
+	packets      [2]int64
+	accepted     int64
+	rejected     int64
+	failed       int64
+	completed    int64
+	verifyFailed int64
+	dials        int64
+	dialTotal    int64 // 发起连接的总耗时，纳秒
+	dialMax      int64
+	dialBuckets  [len(DialLatencyBuckets)]int64 // 各区间的数量，不累计
+	dialErrors   [len(DialErrorReasons)]int64
+}
+
+// dial 记录一次发起成功的连接耗时
+func (T *swapStats) dial(d time.Duration) {
+	atomic.AddInt64(&T.dials, 1)
+	atomic.AddInt64(&T.dialTotal, int64(d))
+	for {
+		max := atomic.LoadInt64(&T.dialMax)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&T.dialMax, max, int64(d)) {
+			break
+		}
+	}
+	for i, le := range DialLatencyBuckets {
+		if d <= le {
+			atomic.AddInt64(&T.dialBuckets[i], 1)
+			break
+		}
+	}
+}
+
+// dialError 记录一次发起连接失败
+func (T *swapStats) dialError(err error) {
+	atomic.AddInt64(&T.dialErrors[dialErrorReason(err)], 1)
+}
+
+// dialErrorReason 失败原因在 DialErrorReasons 中的位置
+func dialErrorReason(err error) int {
+	var (
+		ne  net.Error
+		rec tls.RecordHeaderError
+		uae x509.UnknownAuthorityError
+		hne x509.HostnameError
+		cie x509.CertificateInvalidError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout():
+		return 0
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 1
+	case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH):
+		return 2
+	case errors.As(err, &rec) || errors.As(err, &uae) || errors.As(err, &hne) || errors.As(err, &cie) ||
+		strings.Contains(err.Error(), "tls: "):
+		return 3
+	}
+	return 4
+}
+
+// packet 记录一个UDP数据报
+func (T *swapStats) packet(dir int, n int) {
+	atomic.AddInt64(&T.packets[dir], 1)
+	atomic.AddInt64(&T.bytes[dir], int64(n))
+}
+
+func (T *swapStats) snapshot(conns int) Stats {
+	s := Stats{
+		Conns:          conns,
+		BytesIn:        atomic.LoadInt64(&T.bytes[dirUp]),
+		BytesOut:       atomic.LoadInt64(&T.bytes[dirDown]),
+		PacketsIn:      atomic.LoadInt64(&T.packets[dirUp]),
+		PacketsOut:     atomic.LoadInt64(&T.packets[dirDown]),
+		Accepted:       atomic.LoadInt64(&T.accepted),
+		Rejected:       atomic.LoadInt64(&T.rejected),
+		Failed:         atomic.LoadInt64(&T.failed),
+		Completed:      atomic.LoadInt64(&T.completed),
+		VerifyFailed:   atomic.LoadInt64(&T.verifyFailed),
+		Dials:          atomic.LoadInt64(&T.dials),
+		DialLatencyMax: time.Duration(atomic.LoadInt64(&T.dialMax)),
+	}
+	if s.Dials > 0 {
+		s.DialLatencySum = time.Duration(atomic.LoadInt64(&T.dialTotal))
+		s.DialLatency = s.DialLatencySum / time.Duration(s.Dials)
+	}
+	var n int64
+	for i := range T.dialBuckets {
+		n += atomic.LoadInt64(&T.dialBuckets[i])
+		s.DialHistogram[i] = n
+	}
+	for i := range T.dialErrors {
+		s.DialErrors[i] = atomic.LoadInt64(&T.dialErrors[i])
+	}
+	return s
+}
@@ -0,0 +1,271 @@
+package vforward
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/456vv/vconnpool/v2"
+)
+
+// TLS握手超时
+const tlsHandshakeTimeout = 10 * time.Second
+
+// CertFile 证书文件，文件修改后自动重新加载
+type CertFile struct {
+	CertFile, KeyFile string // 证书，私钥文件路径
+
+	cert    *tls.Certificate
+	modTime time.Time // 文件修改时间
+	checked time.Time // 上次检查时间
+	mu      sync.Mutex
+}
+
+// LoadCertFile 加载证书文件
+//
+//	certFile, keyFile string    证书，私钥文件路径
+//	*CertFile                   证书文件
+//	error                       错误
+func LoadCertFile(certFile, keyFile string) (*CertFile, error) {
+	T := &CertFile{CertFile: certFile, KeyFile: keyFile}
+	if err := T.reload(); err != nil {
+		return nil, err
+	}
+	return T, nil
+}
+
+// 文件最后修改时间
+func (T *CertFile) lastModTime() (time.Time, error) {
+	var mod time.Time
+	for _, name := range []string{T.CertFile, T.KeyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return mod, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, nil
+}
+
+func (T *CertFile) reload() error {
+	mod, err := T.lastModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(T.CertFile, T.KeyFile)
+	if err != nil {
+		return err
+	}
+	T.cert = &cert
+	T.modTime = mod
+	return nil
+}
+
+// Certificate 读取证书，每秒最多检查一次文件是否修改。重新加载失败继续使用旧证书。
+//
+//	*tls.Certificate    证书
+//	error               错误
+func (T *CertFile) Certificate() (*tls.Certificate, error) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	now := time.Now()
+	if T.cert != nil && now.Sub(T.checked) < time.Second {
+		return T.cert, nil
+	}
+	T.checked = now
+	if mod, err := T.lastModTime(); err == nil && mod.Equal(T.modTime) && T.cert != nil {
+		return T.cert, nil
+	}
+	if err := T.reload(); err != nil && T.cert == nil {
+		return nil, err
+	}
+	return T.cert, nil
+}
+
+// GetCertificate 用于 tls.Config.GetCertificate
+func (T *CertFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return T.Certificate()
+}
+
+// TLSConfig 服务端TLS设置，使用该证书
+//
+//	*tls.Config     TLS设置
+func (T *CertFile) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: T.GetCertificate}
+}
+
+// MutualTLSConfig 服务端双向TLS设置，使用该证书，客户端必须出示由 clientCAs 签发的证书
+//
+//	clientCAs *x509.CertPool    客户端CA证书，见 LoadCertPool
+//	*tls.Config                 TLS设置
+func (T *CertFile) MutualTLSConfig(clientCAs *x509.CertPool) *tls.Config {
+	config := T.TLSConfig()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = clientCAs
+	return config
+}
+
+// tlsServer TLS握手，返回解密后的连接
+func tlsServer(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tconn := tls.Server(conn, config)
+	if err := tconn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := tconn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := tconn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// GetClientCertificate 用于 tls.Config.GetClientCertificate
+func (T *CertFile) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return T.Certificate()
+}
+
+// LoadCertPool 从PEM文件加载CA证书
+//
+//	files ...string     CA证书文件
+//	*x509.CertPool      证书池
+//	error               错误
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("vforward: 文件 %s 中没有可用的证书", file)
+		}
+	}
+	return pool, nil
+}
+
+// SPKIHash 证书公钥的SHA256哈希，base64编码，用于证书锁定
+//
+//	cert *x509.Certificate  证书
+//	string                  哈希
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PinSPKI 证书锁定，对方证书链中必须有一个证书的公钥哈希在列表中
+//
+//	config *tls.Config  TLS设置
+//	pins ...string      公钥哈希，见 SPKIHash，可以带 sha256/ 前缀
+func PinSPKI(config *tls.Config, pins ...string) {
+	set := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		set[strings.TrimPrefix(pin, "sha256/")] = true
+	}
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		for _, cert := range cs.PeerCertificates {
+			if set[SPKIHash(cert)] {
+				return nil
+			}
+		}
+		return errors.New("vforward: 证书公钥不在锁定列表中")
+	}
+}
+
+// NewTLSClientConfig 客户端TLS设置。只有锁定公钥而没有CA证书时，不再校验证书链，只校验公钥。
+//
+//	serverName string           校验证书的主机名，空使用连接地址的主机名
+//	caFile string               CA证书文件，空使用系统CA
+//	certFile, keyFile string    客户端证书，私钥文件，空不发送客户端证书
+//	pins ...string              锁定公钥哈希，见 SPKIHash
+//	*tls.Config                 TLS设置
+//	error                       错误
+func NewTLSClientConfig(serverName, caFile, certFile, keyFile string, pins ...string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cf, err := LoadCertFile(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = cf.GetClientCertificate
+	}
+	if len(pins) != 0 {
+		if caFile == "" {
+			config.InsecureSkipVerify = true
+		}
+		PinSPKI(config, pins...)
+	}
+	return config, nil
+}
+
+// tlsClient TLS握手，握手成功后才返回连接
+func tlsClient(ctx context.Context, conn net.Conn, config *tls.Config, address string) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = address
+		}
+	}
+	tconn := tls.Client(conn, config)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(tlsHandshakeTimeout)
+	}
+	if err := tconn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := tconn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// tlsDialer 发起TLS连接
+type tlsDialer struct {
+	Dialer vconnpool.Dialer
+	Config *tls.Config
+}
+
+func (T *tlsDialer) Dial(network, address string) (net.Conn, error) {
+	return T.DialContext(context.Background(), network, address)
+}
+
+func (T *tlsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := T.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return tlsClient(ctx, conn, T.Config, address)
+}
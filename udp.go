@@ -0,0 +1,260 @@
+package vforward
+
+import (
+	"container/list"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 发起连接期间每个会话暂存的数据报数量
+const udpHoldPackets = 64
+
+// udpPacket 待写入远程的数据报
+type udpPacket struct {
+	rw  *readWriteReply
+	buf *[]byte // 来自缓冲池，写入后放回
+	n   int
+}
+
+// udpWorkers 向远程写入数据报的协程，同一个会话的数据报由同一个协程按顺序写入
+type udpWorkers struct {
+	queues  []chan udpPacket
+	bufs    *sync.Pool
+	next    uint32
+	dropped int64 // 队列满丢弃的数据报数量
+
+	mu     sync.RWMutex // 会话发起连接的协程可能在停止之后转发暂存的数据报
+	closed bool
+}
+
+// newUDPWorkers 启动写入协程
+//
+//	n int               协程数量，<=0 使用CPU数量
+//	size int            每个协程的队列长度，<=0 使用1024
+//	bufs *sync.Pool     数据报缓冲池
+func newUDPWorkers(n, size int, bufs *sync.Pool) *udpWorkers {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	if size <= 0 {
+		size = 1024
+	}
+	T := &udpWorkers{queues: make([]chan udpPacket, n), bufs: bufs}
+	for i := range T.queues {
+		T.queues[i] = make(chan udpPacket, size)
+		go T.run(T.queues[i])
+	}
+	return T
+}
+
+// assign 为会话分配协程
+func (T *udpWorkers) assign() int {
+	return int(atomic.AddUint32(&T.next, 1) % uint32(len(T.queues)))
+}
+
+// send 转发会话的数据报，会话还在发起连接时暂存，超过 udpHoldPackets 丢弃
+func (T *udpWorkers) send(p udpPacket) bool {
+	rw := p.rw
+	rw.mu.Lock()
+	if rw.rconn == nil {
+		defer rw.mu.Unlock()
+		if len(rw.pending) >= udpHoldPackets || rw.closed.isTrue() {
+			atomic.AddInt64(&T.dropped, 1)
+			T.bufs.Put(p.buf)
+			return false
+		}
+		rw.pending = append(rw.pending, p)
+		return true
+	}
+	rw.mu.Unlock()
+	return T.push(p)
+}
+
+// push 加入会话的队列，队列满或已停止时丢弃
+func (T *udpWorkers) push(p udpPacket) bool {
+	T.mu.RLock()
+	defer T.mu.RUnlock()
+	if T.closed {
+		T.bufs.Put(p.buf)
+		return false
+	}
+	select {
+	case T.queues[p.rw.worker] <- p:
+		return true
+	default:
+		atomic.AddInt64(&T.dropped, 1)
+		T.bufs.Put(p.buf)
+		return false
+	}
+}
+
+func (T *udpWorkers) run(q chan udpPacket) {
+	var scratch []byte
+	for p := range q {
+		b := (*p.buf)[:p.n]
+		if p.rw.header != nil {
+			// 每个数据报前面加上PROXY协议头
+			scratch = append(append(scratch[:0], p.rw.header...), b...)
+			b = scratch
+		}
+		if _, err := p.rw.rconn.Write(b); err == nil {
+			atomic.AddInt64(&p.rw.sentPackets, 1)
+			atomic.AddInt64(&p.rw.sentBytes, int64(p.n))
+			p.rw.stats.packet(dirUp, p.n)
+		}
+		T.bufs.Put(p.buf)
+	}
+}
+
+// close 停止写入协程，队列中的数据报写完后退出
+func (T *udpWorkers) close() {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	T.closed = true
+	for _, q := range T.queues {
+		close(q)
+	}
+}
+
+// UDPSession UDP会话信息
+type UDPSession struct {
+	Client      net.Addr  // 客户端地址
+	Remote      net.Addr  // 远程地址，发起连接期间为nil
+	Created     time.Time // 建立时间
+	Active      time.Time // 最后活动时间
+	SentPackets int64     // 客户端发往远程的数据报数量
+	SentBytes   int64     // 客户端发往远程的字节数
+	RecvPackets int64     // 远程回应客户端的数据报数量
+	RecvBytes   int64     // 远程回应客户端的字节数
+}
+
+// udpSessions UDP会话表，每个客户端只建立一个会话，超过最大数量时关闭客户端最久没有发送数据的会话
+type udpSessions struct {
+	m   map[string]*list.Element
+	lru list.List // 前面是最近使用的
+	max int
+	mu  sync.Mutex
+}
+
+func newUDPSessions(max int) *udpSessions {
+	return &udpSessions{m: make(map[string]*list.Element), max: max}
+}
+
+// getOrCreate 取得会话，没有则调用 create 建立，create 返回nil表示不能建立
+func (T *udpSessions) getOrCreate(key string, create func() *readWriteReply) *readWriteReply {
+	T.mu.Lock()
+	if e, ok := T.m[key]; ok {
+		T.lru.MoveToFront(e)
+		T.mu.Unlock()
+		return e.Value.(*readWriteReply)
+	}
+	rw := create()
+	if rw == nil {
+		T.mu.Unlock()
+		return nil
+	}
+	T.m[key] = T.lru.PushFront(rw)
+	var evict *readWriteReply
+	if T.max > 0 && T.lru.Len() > T.max {
+		e := T.lru.Back()
+		evict = e.Value.(*readWriteReply)
+		T.lru.Remove(e)
+		delete(T.m, evict.key)
+	}
+	T.mu.Unlock()
+
+	if evict != nil {
+		evict.Close()
+	}
+	return rw
+}
+
+// remove 删除会话
+func (T *udpSessions) remove(rw *readWriteReply) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	if e, ok := T.m[rw.key]; ok && e.Value == rw {
+		T.lru.Remove(e)
+		delete(T.m, rw.key)
+	}
+}
+
+// find 查找会话，不改变使用顺序
+func (T *udpSessions) find(key string) *readWriteReply {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	if e, ok := T.m[key]; ok {
+		return e.Value.(*readWriteReply)
+	}
+	return nil
+}
+
+// list 全部会话，最近使用的在前面
+func (T *udpSessions) list() []*readWriteReply {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+	rws := make([]*readWriteReply, 0, T.lru.Len())
+	for e := T.lru.Front(); e != nil; e = e.Next() {
+		rws = append(rws, e.Value.(*readWriteReply))
+	}
+	return rws
+}
+
+// closeAll 关闭全部会话
+func (T *udpSessions) closeAll() {
+	for _, rw := range T.list() {
+		rw.Close()
+	}
+}
+
+// UDP会话接收回应的来源
+const (
+	UDPReplyConnected = 0 // 只接收远程地址的回应
+	UDPReplySameIP    = 1 // 接收远程IP任意端口的回应
+	UDPReplyAny       = 2 // 接收任意来源的回应
+)
+
+// unconnectedUDP 未连接的UDP，向远程地址写入，按过滤方式接收回应
+type unconnectedUDP struct {
+	*net.UDPConn
+	raddr  *net.UDPAddr
+	filter int
+}
+
+// listenUDP 建立未连接的UDP会话
+//
+//	addr *Addr      远程地址，Remote 是 *net.UDPAddr，由 dialUDP 判断
+//	filter int      接收回应的来源，UDPReplySameIP 或 UDPReplyAny
+//	net.Conn        连接
+//	error           错误
+func listenUDP(addr *Addr, filter int) (net.Conn, error) {
+	raddr := addr.Remote.(*net.UDPAddr)
+	conn, err := net.ListenUDP(addr.Network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &unconnectedUDP{UDPConn: conn, raddr: raddr, filter: filter}, nil
+}
+
+func (T *unconnectedUDP) Write(b []byte) (int, error) {
+	return T.WriteToUDP(b, T.raddr)
+}
+
+func (T *unconnectedUDP) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := T.ReadFromUDP(b)
+		if err != nil {
+			return n, err
+		}
+		if T.filter == UDPReplyAny || addr.IP.Equal(T.raddr.IP) {
+			return n, nil
+		}
+	}
+}
+
+func (T *unconnectedUDP) RemoteAddr() net.Addr {
+	return T.raddr
+}